@@ -0,0 +1,289 @@
+package httpstats
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xstats"
+)
+
+// aggregateMaxSamples is the number of samples buffered for a single metric
+// before they are sent without waiting for the flush interval.
+const aggregateMaxSamples = 512
+
+// valuesSender is implemented by senders that can emit several samples of a
+// metric in a single multi-value line, such as name:1:2:3|h.
+type valuesSender interface {
+	sendValues(stat string, values []float64, kind string, tags []string)
+}
+
+// sendSamples emits the samples as multi-value lines if the sender supports
+// them and one at a time otherwise. The values of a MultiSender are checked
+// individually. Timing samples are given in milliseconds.
+func sendSamples(sender xstats.Sender, stat string, values []float64, kind string, tags []string) {
+	switch s := sender.(type) {
+	case valuesSender:
+		s.sendValues(stat, values, kind, tags)
+	case xstats.MultiSender:
+		for _, ss := range s {
+			sendSamples(ss, stat, values, kind, tags)
+		}
+	default:
+		for _, value := range values {
+			switch kind {
+			case "ms":
+				sender.Timing(stat, time.Duration(value*float64(time.Millisecond)), tags...)
+			case "d":
+				sendDistribution(sender, stat, value, tags...)
+			case timingDistributionKind:
+				sendTimingDistribution(sender, stat, value, tags...)
+			default:
+				sender.Histogram(stat, value, tags...)
+			}
+		}
+	}
+}
+
+// aggregate is the merged value, or the buffered samples, of a metric with
+// a single tag set.
+type aggregate struct {
+	stat   string
+	kind   string
+	tags   []string
+	value  float64
+	values []float64
+}
+
+// aggregateKey identifies a metric by its type, name, and tag set. The order
+// of the tags is not significant.
+func aggregateKey(stat string, kind string, tags []string) string {
+	var sorted = append(make([]string, 0, len(tags)), tags...)
+	sort.Strings(sorted)
+	return kind + "|" + stat + "|" + strings.Join(sorted, ",")
+}
+
+// AggregatingSender is an xstats.Sender that merges metrics in process before
+// passing them to the wrapped sender on each flush interval. Counts with the
+// same name and tags are summed and gauges keep the most recent value. If
+// multi-value packets are enabled then timer, histogram, and distribution
+// samples are also buffered and sent together using the datadog multi-value
+// format, such as service_time:1.5:2.25|ms, by senders that support it.
+// Otherwise they are passed through as they are recorded.
+type AggregatingSender struct {
+	sender     xstats.Sender
+	interval   time.Duration
+	multiValue bool
+	lock       *sync.Mutex
+	aggregates map[string]*aggregate
+	closed     bool
+	started    bool
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// AggregatingOption is used to configure an AggregatingSender.
+type AggregatingOption func(*AggregatingSender) *AggregatingSender
+
+// AggregatingOptionMultiValue buffers timer, histogram, and distribution
+// samples so that each metric and tag set is sent as multi-value lines.
+func AggregatingOptionMultiValue() AggregatingOption {
+	return func(s *AggregatingSender) *AggregatingSender {
+		s.multiValue = true
+		return s
+	}
+}
+
+// NewAggregatingSender creates an AggregatingSender that writes to the given
+// sender. A flush interval less than or equal to zero disables periodic
+// flushing. The wrapped sender is not flushed or closed by the aggregator.
+func NewAggregatingSender(sender xstats.Sender, flushInterval time.Duration, options ...AggregatingOption) *AggregatingSender {
+	var s = &AggregatingSender{
+		sender:     sender,
+		interval:   flushInterval,
+		lock:       &sync.Mutex{},
+		aggregates: make(map[string]*aggregate),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for _, option := range options {
+		s = option(s)
+	}
+	if s.interval > 0 {
+		s.started = true
+		go s.run()
+	}
+	return s
+}
+
+func (s *AggregatingSender) run() {
+	defer close(s.done)
+	var ticker = time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// merge applies the update to the aggregate for the metric. If the update
+// returns true then the aggregate is removed and sent immediately.
+func (s *AggregatingSender) merge(stat string, kind string, tags []string, update func(*aggregate) bool) {
+	var key = aggregateKey(stat, kind, tags)
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	var current, ok = s.aggregates[key]
+	if !ok {
+		current = &aggregate{stat: stat, kind: kind, tags: append(make([]string, 0, len(tags)), tags...)}
+		s.aggregates[key] = current
+	}
+	var full = update(current)
+	if full {
+		delete(s.aggregates, key)
+	}
+	s.lock.Unlock()
+	if full {
+		s.send(current)
+	}
+}
+
+func (s *AggregatingSender) sample(stat string, value float64, kind string, tags []string) {
+	s.merge(stat, kind, tags, func(a *aggregate) bool {
+		a.values = append(a.values, value)
+		return len(a.values) >= aggregateMaxSamples
+	})
+}
+
+func (s *AggregatingSender) send(a *aggregate) {
+	switch a.kind {
+	case "g":
+		s.sender.Gauge(a.stat, a.value, a.tags...)
+	case "c":
+		s.sender.Count(a.stat, a.value, a.tags...)
+	default:
+		sendSamples(s.sender, a.stat, a.values, a.kind, a.tags)
+	}
+}
+
+func (s *AggregatingSender) flush() {
+	s.lock.Lock()
+	var aggregates = s.aggregates
+	s.aggregates = make(map[string]*aggregate, len(aggregates))
+	s.lock.Unlock()
+	for _, a := range aggregates {
+		s.send(a)
+	}
+}
+
+// Gauge implements the xstats.Sender interface.
+func (s *AggregatingSender) Gauge(stat string, value float64, tags ...string) {
+	s.merge(stat, "g", tags, func(a *aggregate) bool {
+		a.value = value
+		return false
+	})
+}
+
+// Count implements the xstats.Sender interface.
+func (s *AggregatingSender) Count(stat string, count float64, tags ...string) {
+	s.merge(stat, "c", tags, func(a *aggregate) bool {
+		a.value = a.value + count
+		return false
+	})
+}
+
+// Histogram implements the xstats.Sender interface.
+func (s *AggregatingSender) Histogram(stat string, value float64, tags ...string) {
+	if !s.multiValue {
+		s.sender.Histogram(stat, value, tags...)
+		return
+	}
+	s.sample(stat, value, "h", tags)
+}
+
+// Timing implements the xstats.Sender interface.
+func (s *AggregatingSender) Timing(stat string, duration time.Duration, tags ...string) {
+	if !s.multiValue {
+		s.sender.Timing(stat, duration, tags...)
+		return
+	}
+	s.sample(stat, duration.Seconds()*1000, "ms", tags)
+}
+
+// Distribution implements the DistributionSender interface.
+func (s *AggregatingSender) Distribution(stat string, value float64, tags ...string) {
+	if !s.multiValue {
+		sendDistribution(s.sender, stat, value, tags...)
+		return
+	}
+	s.sample(stat, value, "d", tags)
+}
+
+func (s *AggregatingSender) timingDistribution(stat string, value float64, tags ...string) {
+	if !s.multiValue {
+		sendTimingDistribution(s.sender, stat, value, tags...)
+		return
+	}
+	s.sample(stat, value, timingDistributionKind, tags)
+}
+
+// Flush writes the aggregated metrics to the wrapped sender.
+func (s *AggregatingSender) Flush(ctx context.Context) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	s.flush()
+	return nil
+}
+
+// Close stops the periodic flushing and writes the aggregated metrics to the
+// wrapped sender. Metrics recorded after Close are dropped. Calling Close
+// more than once has no effect.
+func (s *AggregatingSender) Close(ctx context.Context) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	var aggregates = s.aggregates
+	s.aggregates = make(map[string]*aggregate)
+	s.closed = true
+	s.lock.Unlock()
+	if s.started {
+		if e := stopTracker(ctx, s.stop, s.done); e != nil {
+			return e
+		}
+	}
+	for _, a := range aggregates {
+		s.send(a)
+	}
+	return nil
+}
+
+// aggregation holds the settings of MiddlewareOptionAggregation until the
+// senders of the Middleware are known.
+type aggregation struct {
+	interval time.Duration
+	options  []AggregatingOption
+}
+
+// MiddlewareOptionAggregation merges counts and gauges in process and sends
+// them once per flush interval. AggregatingOptionMultiValue may be given to
+// also send timer and histogram samples as multi-value lines. The aggregated
+// metrics are written by the FlushCloser returned from NewMiddlewareCloser
+// before the senders are flushed. This option has no effect when combined
+// with MiddlewareOptionSynchronousFlush.
+func MiddlewareOptionAggregation(flushInterval time.Duration, options ...AggregatingOption) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.aggregation = &aggregation{interval: flushInterval, options: options}
+		return m, nil
+	}
+}
@@ -0,0 +1,171 @@
+package httpstats
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+// sortedLines flushes the sender and returns each line it wrote, sorted.
+func sortedLines(t *testing.T, s *StatsdSender, w *packetWriter) []string {
+	assert.NoError(t, s.Flush(context.Background()))
+	var lines []string
+	for _, packet := range w.written() {
+		lines = append(lines, strings.Split(strings.TrimSuffix(packet, "\n"), "\n")...)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestAggregatingSenderCountsAndGauges(t *testing.T) {
+	var w = newPacketWriter()
+	var statsd = NewStatsdSender(w, 1024, 0)
+	var s = NewAggregatingSender(statsd, 0)
+	s.Count("count", 1, "a:b", "c:d")
+	s.Count("count", 2, "c:d", "a:b")
+	s.Count("count", 1, "a:x")
+	s.Gauge("gauge", 1)
+	s.Gauge("gauge", 5)
+	assert.Empty(t, sortedLines(t, statsd, w))
+
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.Equal(t, []string{
+		"count:1.000000|c|#a:x",
+		"count:3.000000|c|#a:b,c:d",
+		"gauge:5.000000|g",
+	}, sortedLines(t, statsd, w))
+}
+
+func TestAggregatingSenderPassthrough(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var sender = NewMockSender(ctrl)
+	sender.EXPECT().Histogram("histogram", 1.0, "a:b")
+	sender.EXPECT().Timing("timing", time.Second, "a:b")
+	var s = NewAggregatingSender(sender, 0)
+	s.Histogram("histogram", 1, "a:b")
+	s.Timing("timing", time.Second, "a:b")
+}
+
+func TestAggregatingSenderMultiValue(t *testing.T) {
+	var w = newPacketWriter()
+	var statsd = NewStatsdSender(w, 1024, 0)
+	var s = NewAggregatingSender(statsd, 0, AggregatingOptionMultiValue())
+	s.Timing("timing", time.Millisecond, "a:b")
+	s.Timing("timing", 2500*time.Microsecond, "a:b")
+	s.Histogram("histogram", 3)
+	s.Histogram("histogram", 4)
+	s.Distribution("distribution", 5)
+	s.timingDistribution("timing_distribution", 1.5)
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.Equal(t, []string{
+		"distribution:5.000000|d",
+		"histogram:3.000000:4.000000|h",
+		"timing:1.000000:2.500000|ms|#a:b",
+		"timing_distribution:1.500000|d",
+	}, sortedLines(t, statsd, w))
+}
+
+func TestAggregatingSenderMultiValueFallback(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var sender = NewMockSender(ctrl)
+	sender.EXPECT().Timing("timing", 2*time.Millisecond, "a:b").Times(2)
+	var s = NewAggregatingSender(sender, 0, AggregatingOptionMultiValue())
+	s.Timing("timing", 2*time.Millisecond, "a:b")
+	s.Timing("timing", 2*time.Millisecond, "a:b")
+	assert.NoError(t, s.Flush(context.Background()))
+}
+
+func TestAggregatingSenderMaxSamples(t *testing.T) {
+	var w = newPacketWriter()
+	var statsd = NewStatsdSender(w, 1<<16, 0)
+	var s = NewAggregatingSender(statsd, 0, AggregatingOptionMultiValue())
+	for x := 0; x < aggregateMaxSamples; x = x + 1 {
+		s.Histogram("histogram", 1)
+	}
+	var lines = sortedLines(t, statsd, w)
+	assert.Len(t, lines, 1)
+	assert.Equal(t, aggregateMaxSamples, strings.Count(lines[0], ":"))
+}
+
+func TestAggregatingSenderClose(t *testing.T) {
+	var w = newPacketWriter()
+	var statsd = NewStatsdSender(w, 1024, 0)
+	var s = NewAggregatingSender(statsd, time.Hour)
+	s.Count("count", 1)
+	assert.NoError(t, s.Close(context.Background()))
+	s.Count("count", 1)
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.NoError(t, s.Close(context.Background()))
+	assert.Equal(t, []string{"count:1.000000|c"}, sortedLines(t, statsd, w))
+}
+
+func TestStatsdValueLines(t *testing.T) {
+	var lines = statsdValueLines("p.", "stat", []float64{1, 2, 3}, "h", []string{"a:b"}, 1024)
+	assert.Equal(t, []string{"p.stat:1.000000:2.000000:3.000000|h|#a:b\n"}, lines)
+
+	var single = len("stat:1.000000|h\n")
+	lines = statsdValueLines("", "stat", []float64{1, 2, 3}, "h", nil, single+len(":2.000000"))
+	assert.Equal(t, []string{"stat:1.000000:2.000000|h\n", "stat:3.000000|h\n"}, lines)
+
+	lines = statsdValueLines("", "stat", []float64{1, 2}, "h", nil, 1)
+	assert.Equal(t, []string{"stat:1.000000|h\n", "stat:2.000000|h\n"}, lines)
+}
+
+func TestRollupStatWrapperSendValues(t *testing.T) {
+	var w = newPacketWriter()
+	var statsd = NewStatsdSender(w, 1024, 0)
+	var rollup = &rollupStatWrapper{Sender: statsd, globals: []string{"region"}}
+	sendSamples(rollup, "timing", []float64{1, 2}, "ms", []string{"region:us-west-2"})
+	sendSamples(rollup, "distribution", []float64{3}, "d", []string{"region:us-west-2"})
+	assert.Equal(t, []string{
+		"distribution:3.000000|d|#region:us-west-2",
+		"timing:1.000000:2.000000|ms|#region:global",
+	}, sortedLines(t, statsd, w))
+}
+
+func TestMiddlewareOptionAggregation(t *testing.T) {
+	var w = newPacketWriter()
+	var statsd = NewStatsdSender(w, 1<<15, 0)
+	var result, _, closer, e = NewMiddlewareCloser(
+		middlewareOptionSender(statsd),
+		MiddlewareOptionAggregation(time.Hour, AggregatingOptionMultiValue()),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var handler = result(fixtureHandler{})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Empty(t, sortedLines(t, statsd, w))
+
+	assert.NoError(t, closer.Flush(context.Background()))
+	var lines = sortedLines(t, statsd, w)
+	assert.Len(t, lines, 4)
+	for _, line := range lines {
+		assert.Equal(t, 2, strings.Count(strings.SplitN(line, "|", 2)[0], ":"), line)
+	}
+}
+
+func TestMiddlewareOptionAggregationSynchronous(t *testing.T) {
+	var w = newPacketWriter()
+	var statsd = NewStatsdSender(w, 1<<15, 0)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(statsd),
+		MiddlewareOptionAggregation(time.Hour),
+		MiddlewareOptionSynchronousFlush(),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	result(fixtureHandler{}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Len(t, sortedLines(t, statsd, w), 4)
+}
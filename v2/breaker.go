@@ -0,0 +1,431 @@
+package httpstats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/xstats"
+)
+
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+	breakerBuckets  = 10
+)
+
+// BreakerOpenError is returned by the Breaker when a request is rejected
+// because the circuit for the target host is open.
+type BreakerOpenError struct {
+	Host string
+	// RetryAfter is the time remaining before the circuit allows a trial
+	// request. It is zero if a trial request is already in progress.
+	RetryAfter time.Duration
+}
+
+func (e *BreakerOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for %s", e.Host)
+}
+
+type breakerBucket struct {
+	start    time.Time
+	total    int
+	failures int
+}
+
+// breakerCircuit tracks the rolling outcomes and the state of the circuit for
+// a single host.
+type breakerCircuit struct {
+	lock     *sync.Mutex
+	state    int
+	openedAt time.Time
+	probing  bool
+	buckets  [breakerBuckets]breakerBucket
+	requests int
+	lastUsed time.Time
+}
+
+// allow reports whether a request may proceed and whether it is the trial
+// request of a half-open circuit. Requests that are not allowed are complete
+// and must not call complete.
+func (c *breakerCircuit) allow(now time.Time, openDuration time.Duration) (allowed bool, probe bool, retryAfter time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch c.state {
+	case breakerOpen:
+		var elapsed = now.Sub(c.openedAt)
+		if elapsed < openDuration {
+			c.reject(now)
+			return false, false, openDuration - elapsed
+		}
+		c.state = breakerHalfOpen
+		c.probing = true
+		return true, true, 0
+	case breakerHalfOpen:
+		if c.probing {
+			c.reject(now)
+			return false, false, 0
+		}
+		c.probing = true
+		return true, true, 0
+	}
+	return true, false, 0
+}
+
+// reject ends a request that was not allowed. It must be called with the lock
+// held.
+func (c *breakerCircuit) reject(now time.Time) {
+	c.requests--
+	c.lastUsed = now
+}
+
+// idle reports whether the circuit is closed, has no requests in progress,
+// and has not been used for the given duration. Such a circuit holds no
+// outcomes within the window and can be discarded.
+func (c *breakerCircuit) idle(now time.Time, window time.Duration) bool {
+	return c.state == breakerClosed && c.requests == 0 && now.Sub(c.lastUsed) >= window
+}
+
+// complete records the outcome of a request and returns the resulting state.
+// A trial request that was cancelled by the caller says nothing about the
+// host so the circuit stays half-open and allows another trial.
+func (c *breakerCircuit) complete(now time.Time, failed bool, cancelled bool, probe bool, b *Breaker) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.requests--
+	c.lastUsed = now
+	if probe {
+		c.probing = false
+		if cancelled {
+			return c.state
+		}
+		if failed {
+			c.state = breakerOpen
+			c.openedAt = now
+			return c.state
+		}
+		c.state = breakerClosed
+		c.buckets = [breakerBuckets]breakerBucket{}
+		return c.state
+	}
+	if c.state != breakerClosed {
+		return c.state
+	}
+	var total, failures = c.record(now, b.window, failed)
+	if total >= b.minRequests && float64(failures)/float64(total) >= b.errorRate {
+		c.state = breakerOpen
+		c.openedAt = now
+	}
+	return c.state
+}
+
+// record adds an outcome to the rolling window and returns the totals for
+// the window.
+func (c *breakerCircuit) record(now time.Time, window time.Duration, failed bool) (int, int) {
+	var width = window / breakerBuckets
+	if width <= 0 {
+		width = 1
+	}
+	var start = now.Truncate(width)
+	var bucket = &c.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	bucket.total++
+	if failed {
+		bucket.failures++
+	}
+	var total, failures int
+	for _, b := range c.buckets {
+		if now.Sub(b.start) < window {
+			total += b.total
+			failures += b.failures
+		}
+	}
+	return total, failures
+}
+
+// Breaker is an http.RoundTripper wrapper that tracks the rolling error rate
+// and latency of requests to each host and stops sending requests to hosts
+// that are failing.
+type Breaker struct {
+	tags             []string
+	next             http.RoundTripper
+	stat             xstats.XStater
+	interval         time.Duration
+	window           time.Duration
+	errorRate        float64
+	minRequests      int
+	openDuration     time.Duration
+	latencyThreshold time.Duration
+	failureStatuses  map[string]bool
+	statusClassifier StatusClassifier
+	state            string
+	rejections       string
+	lock             *sync.Mutex
+	circuits         map[string]*breakerCircuit
+	now              func() time.Time
+	stop             chan struct{}
+	done             chan struct{}
+	closeOnce        *sync.Once
+}
+
+// circuit returns the circuit for the host, creating it if needed, and counts
+// the request against it so that it is not discarded while in use.
+func (t *Breaker) circuit(host string) *breakerCircuit {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var c, ok = t.circuits[host]
+	if !ok {
+		c = &breakerCircuit{lock: &sync.Mutex{}}
+		t.circuits[host] = c
+	}
+	c.lock.Lock()
+	c.requests++
+	c.lock.Unlock()
+	return c
+}
+
+// RoundTrip sends the request unless the circuit for the host is open and
+// records the outcome against the circuit.
+func (t *Breaker) RoundTrip(r *http.Request) (*http.Response, error) {
+	var host = r.URL.Host
+	var c = t.circuit(host)
+	var allowed, probe, retryAfter = c.allow(t.now(), t.openDuration)
+	if !allowed {
+		var tags = make([]string, 0, len(t.tags)+2)
+		tags = append(tags, t.tags...)
+		tags = append(tags, fmt.Sprintf("host:%s", host), fmt.Sprintf("method:%s", r.Method))
+		xstats.FromRequest(r).Count(t.rejections, 1, tags...)
+		return nil, &BreakerOpenError{Host: host, RetryAfter: retryAfter}
+	}
+	var start = t.now()
+	var resp, e = t.next.RoundTrip(r)
+	var end = t.now()
+	var _, status = roundTripOutcome(t.statusClassifier, r, resp, e)
+	var failed = t.failureStatuses[status] || (t.latencyThreshold > 0 && end.Sub(start) > t.latencyThreshold)
+	var cancelled = errors.Is(r.Context().Err(), context.Canceled)
+	c.complete(end, failed, cancelled, probe, t)
+	return resp, e
+}
+
+// flush emits the state of each circuit. Circuits that have been closed and
+// unused for a full window are removed after reporting so that the number of
+// tracked hosts does not grow without bound.
+func (t *Breaker) flush() {
+	var now = t.now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for host, c := range t.circuits {
+		c.lock.Lock()
+		var state = c.state
+		var idle = c.idle(now, t.window)
+		c.lock.Unlock()
+		var tags = make([]string, 0, len(t.tags)+1)
+		tags = append(tags, t.tags...)
+		tags = append(tags, fmt.Sprintf("host:%s", host))
+		t.stat.Gauge(t.state, float64(state), tags...)
+		if idle {
+			delete(t.circuits, host)
+		}
+	}
+}
+
+func (t *Breaker) run() {
+	defer close(t.done)
+	var ticker = time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Flush emits the client_breaker_state gauges.
+func (t *Breaker) Flush(ctx context.Context) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	t.flush()
+	return nil
+}
+
+// Close stops the periodic emission of the gauges and emits them one last
+// time. Calling Close more than once has no effect.
+func (t *Breaker) Close(ctx context.Context) error {
+	var e error
+	t.closeOnce.Do(func() {
+		if t.interval > 0 {
+			if e = stopTracker(ctx, t.stop, t.done); e != nil {
+				return
+			}
+		}
+		t.flush()
+	})
+	return e
+}
+
+// BreakerOption is used to configure the circuit breaker middleware.
+type BreakerOption func(*Breaker) (*Breaker, error)
+
+// BreakerOptionTag adds a static key/value annotation to all metrics emitted
+// by the middleware.
+func BreakerOptionTag(tagName string, tagValue string) BreakerOption {
+	return func(m *Breaker) (*Breaker, error) {
+		m.tags = append(m.tags, fmt.Sprintf("%s:%s", tagName, tagValue))
+		return m, nil
+	}
+}
+
+// BreakerOptionWindow sets the duration of the rolling window over which the
+// error rate is computed. The default value is 10s.
+func BreakerOptionWindow(window time.Duration) BreakerOption {
+	return func(m *Breaker) (*Breaker, error) {
+		if window <= 0 {
+			return nil, fmt.Errorf("breaker window must be positive: %s", window)
+		}
+		m.window = window
+		return m, nil
+	}
+}
+
+// BreakerOptionErrorRate sets the fraction of failed requests within the
+// window at which the circuit opens. The default value is 0.5.
+func BreakerOptionErrorRate(rate float64) BreakerOption {
+	return func(m *Breaker) (*Breaker, error) {
+		if !(rate > 0 && rate <= 1) {
+			return nil, fmt.Errorf("breaker error rate must be greater than zero and at most one: %v", rate)
+		}
+		m.errorRate = rate
+		return m, nil
+	}
+}
+
+// BreakerOptionMinRequests sets the number of requests that must be seen
+// within the window before the circuit may open. The default value is 20.
+func BreakerOptionMinRequests(requests int) BreakerOption {
+	return func(m *Breaker) (*Breaker, error) {
+		if requests < 1 {
+			return nil, fmt.Errorf("breaker minimum requests must be positive: %d", requests)
+		}
+		m.minRequests = requests
+		return m, nil
+	}
+}
+
+// BreakerOptionOpenDuration sets how long the circuit stays open before a
+// single trial request is allowed through. The circuit closes if the trial
+// succeeds and opens again if it fails. The default value is 5s.
+func BreakerOptionOpenDuration(duration time.Duration) BreakerOption {
+	return func(m *Breaker) (*Breaker, error) {
+		if duration <= 0 {
+			return nil, fmt.Errorf("breaker open duration must be positive: %s", duration)
+		}
+		m.openDuration = duration
+		return m, nil
+	}
+}
+
+// BreakerOptionLatencyThreshold sets a duration above which requests are
+// counted as failures regardless of their status. The default value of zero
+// disables the latency check.
+func BreakerOptionLatencyThreshold(threshold time.Duration) BreakerOption {
+	return func(m *Breaker) (*Breaker, error) {
+		m.latencyThreshold = threshold
+		return m, nil
+	}
+}
+
+// BreakerOptionFailureStatuses sets the status values that are counted as
+// failures. The default values are server_error and timeout.
+func BreakerOptionFailureStatuses(statuses ...string) BreakerOption {
+	return func(m *Breaker) (*Breaker, error) {
+		m.failureStatuses = make(map[string]bool, len(statuses))
+		for _, status := range statuses {
+			m.failureStatuses[status] = true
+		}
+		return m, nil
+	}
+}
+
+// BreakerOptionStatusClassifier sets the classifier used to determine the
+// status of each request. The default is StatusClassifierClass.
+func BreakerOptionStatusClassifier(classifier StatusClassifier) BreakerOption {
+	return func(m *Breaker) (*Breaker, error) {
+		m.statusClassifier = classifier
+		return m, nil
+	}
+}
+
+// BreakerOptionStateName sets the name of the gauge used to report the state
+// of each circuit. The gauge is 0 when closed, 1 when half-open, and 2 when
+// open. The default value is client_breaker_state.
+func BreakerOptionStateName(name string) BreakerOption {
+	return func(m *Breaker) (*Breaker, error) {
+		m.state = name
+		return m, nil
+	}
+}
+
+// BreakerOptionRejectionsName sets the name of the metric used to count the
+// requests rejected by an open circuit. The default value is
+// client_breaker_rejections.
+func BreakerOptionRejectionsName(name string) BreakerOption {
+	return func(m *Breaker) (*Breaker, error) {
+		m.rejections = name
+		return m, nil
+	}
+}
+
+// NewBreaker configures and returns an HTTP circuit breaker middleware.
+// Requests rejected by an open circuit fail with a *BreakerOpenError.
+//
+// On each interval the client_breaker_state gauge is emitted to the given
+// stat client for each host, tagged with host, until the Breaker is closed
+// with Close. Hosts whose circuit is closed and that have not been used for a
+// full window are then forgotten. If the interval is less than or equal to
+// zero then the gauges are only emitted by Flush and Close.
+func NewBreaker(stat xstats.XStater, interval time.Duration, options ...BreakerOption) (func(http.RoundTripper) http.RoundTripper, error) {
+	xstats.DisablePooling = true
+	var e error
+	var b = &Breaker{
+		stat:             stat,
+		interval:         interval,
+		window:           10 * time.Second,
+		errorRate:        0.5,
+		minRequests:      20,
+		openDuration:     5 * time.Second,
+		failureStatuses:  map[string]bool{serverErrorName: true, "timeout": true},
+		statusClassifier: StatusClassifierClass,
+		state:            "client_breaker_state",
+		rejections:       "client_breaker_rejections",
+		now:              time.Now,
+	}
+	for _, option := range options {
+		b, e = option(b)
+		if e != nil {
+			return nil, e
+		}
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		var m = *b
+		m.next = next
+		m.lock = &sync.Mutex{}
+		m.circuits = make(map[string]*breakerCircuit)
+		m.stop = make(chan struct{})
+		m.done = make(chan struct{})
+		m.closeOnce = &sync.Once{}
+		if m.interval > 0 {
+			go m.run()
+		}
+		return &m
+	}, nil
+}
@@ -0,0 +1,212 @@
+package httpstats
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/xstats"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func TestBreakerCircuitRecord(t *testing.T) {
+	var c = &breakerCircuit{}
+	var now = time.Unix(1000, 0)
+	var total, failures = c.record(now, 10*time.Second, true)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, 1, failures)
+	total, failures = c.record(now.Add(5*time.Second), 10*time.Second, false)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, 1, failures)
+	total, failures = c.record(now.Add(12*time.Second), 10*time.Second, false)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, 0, failures)
+}
+
+// newTestBreaker returns a Breaker for the transport with a fixed clock that
+// the caller may advance.
+func newTestBreaker(t *testing.T, stat xstats.XStater, next http.RoundTripper, now *time.Time, options ...BreakerOption) *Breaker {
+	var result, e = NewBreaker(stat, 0, options...)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var b = result(next).(*Breaker)
+	b.now = func() time.Time { return *now }
+	return b
+}
+
+func TestBreaker(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var stat = xstats.New(sender)
+	var statusCode = http.StatusServiceUnavailable
+	var calls int
+	var next = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		return statusTransport(statusCode).RoundTrip(r)
+	})
+	var now = time.Unix(1000, 0)
+	var b = newTestBreaker(t, stat, next, &now,
+		BreakerOptionTag(testName, testName),
+		BreakerOptionMinRequests(2),
+		BreakerOptionErrorRate(0.5),
+		BreakerOptionOpenDuration(time.Second),
+		BreakerOptionStateName("state"),
+		BreakerOptionRejectionsName("rejections"),
+	)
+	var send = func() error {
+		var req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(xstats.NewContext(context.Background(), stat))
+		var _, e = b.RoundTrip(req)
+		return e
+	}
+
+	assert.NoError(t, send())
+	sender.EXPECT().Gauge("state", float64(breakerClosed), "test:test", "host:example.com")
+	assert.NoError(t, b.Flush(context.Background()))
+	assert.NoError(t, send())
+	sender.EXPECT().Gauge("state", float64(breakerOpen), "test:test", "host:example.com")
+	assert.NoError(t, b.Flush(context.Background()))
+
+	sender.EXPECT().Count("rejections", float64(1), "test:test", "host:example.com", "method:GET")
+	var e = send()
+	var breakerErr *BreakerOpenError
+	assert.True(t, errors.As(e, &breakerErr))
+	assert.Equal(t, "example.com", breakerErr.Host)
+	assert.Equal(t, time.Second, breakerErr.RetryAfter)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, http.StatusServiceUnavailable, errorToStatusCode(e))
+
+	// The trial request fails and the circuit opens again.
+	now = now.Add(time.Second)
+	assert.NoError(t, send())
+	sender.EXPECT().Gauge("state", float64(breakerOpen), "test:test", "host:example.com")
+	assert.NoError(t, b.Flush(context.Background()))
+
+	// The trial request succeeds and the circuit closes.
+	now = now.Add(time.Second)
+	statusCode = http.StatusOK
+	assert.NoError(t, send())
+	assert.NoError(t, send())
+	assert.Equal(t, 5, calls)
+	sender.EXPECT().Gauge("state", float64(breakerClosed), "test:test", "host:example.com")
+	assert.NoError(t, b.Close(context.Background()))
+	assert.NoError(t, b.Close(context.Background()))
+}
+
+func TestBreakerEvictsIdleCircuits(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var stat = xstats.New(sender)
+	var now = time.Unix(1000, 0)
+	var b = newTestBreaker(t, stat, statusTransport(http.StatusOK), &now, BreakerOptionWindow(time.Second))
+	var req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(xstats.NewContext(context.Background(), stat))
+	var _, e = b.RoundTrip(req)
+	assert.NoError(t, e)
+
+	sender.EXPECT().Gauge("client_breaker_state", float64(breakerClosed), "host:example.com")
+	assert.NoError(t, b.Flush(context.Background()))
+	assert.Len(t, b.circuits, 1)
+
+	// The circuit reports once more after a full idle window and is then
+	// removed.
+	now = now.Add(time.Second)
+	sender.EXPECT().Gauge("client_breaker_state", float64(breakerClosed), "host:example.com")
+	assert.NoError(t, b.Flush(context.Background()))
+	assert.Empty(t, b.circuits)
+
+	// Circuits with requests in progress are kept.
+	var c = b.circuit("example.com")
+	now = now.Add(time.Minute)
+	sender.EXPECT().Gauge("client_breaker_state", float64(breakerClosed), "host:example.com")
+	assert.NoError(t, b.Flush(context.Background()))
+	assert.Len(t, b.circuits, 1)
+	c.complete(now, false, false, false, b)
+}
+
+func TestBreakerInterval(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	sender.EXPECT().Gauge("client_breaker_state", float64(breakerClosed), "host:example.com").MinTimes(2)
+	var result, e = NewBreaker(xstats.New(sender), time.Millisecond)
+	assert.NoError(t, e)
+	var b = result(statusTransport(http.StatusOK)).(*Breaker)
+	var req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	var resp, _ = b.RoundTrip(req)
+	resp.Body.Close()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, b.Close(context.Background()))
+}
+
+func TestBreakerHalfOpenRejectsConcurrent(t *testing.T) {
+	var c = &breakerCircuit{lock: &sync.Mutex{}, state: breakerOpen}
+	var now = time.Unix(1000, 0)
+	c.openedAt = now.Add(-time.Minute)
+	var allowed, probe, _ = c.allow(now, time.Second)
+	assert.True(t, allowed)
+	assert.True(t, probe)
+	allowed, _, _ = c.allow(now, time.Second)
+	assert.False(t, allowed)
+}
+
+func TestBreakerCancelledProbe(t *testing.T) {
+	var c = &breakerCircuit{lock: &sync.Mutex{}, state: breakerOpen}
+	var now = time.Unix(1000, 0)
+	var b = newTestBreaker(t, xstats.FromContext(context.Background()), http.DefaultTransport, &now)
+	var _, probe, _ = c.allow(now, time.Second)
+	assert.True(t, probe)
+	assert.Equal(t, breakerHalfOpen, c.complete(now, false, true, probe, b))
+
+	// The next request is allowed as a new trial.
+	var allowed bool
+	allowed, probe, _ = c.allow(now, time.Second)
+	assert.True(t, allowed)
+	assert.True(t, probe)
+	assert.Equal(t, breakerClosed, c.complete(now, false, false, probe, b))
+}
+
+func TestBreakerOptionsInvalid(t *testing.T) {
+	for _, option := range []BreakerOption{
+		BreakerOptionWindow(0),
+		BreakerOptionErrorRate(0),
+		BreakerOptionErrorRate(1.5),
+		BreakerOptionMinRequests(0),
+		BreakerOptionOpenDuration(-time.Second),
+	} {
+		var _, e = NewBreaker(xstats.FromContext(context.Background()), 0, option)
+		assert.Error(t, e)
+	}
+}
+
+func TestBreakerLatencyThreshold(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var stat = xstats.New(sender)
+	var now = time.Unix(1000, 0)
+	var b = newTestBreaker(t, stat, roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		now = now.Add(2 * time.Second)
+		return statusTransport(http.StatusOK).RoundTrip(r)
+	}), &now,
+		BreakerOptionMinRequests(1),
+		BreakerOptionLatencyThreshold(time.Second),
+		BreakerOptionFailureStatuses(),
+	)
+
+	var req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(xstats.NewContext(context.Background(), stat))
+	var _, e = b.RoundTrip(req)
+	assert.NoError(t, e)
+	sender.EXPECT().Gauge("client_breaker_state", float64(breakerOpen), "host:example.com")
+	assert.NoError(t, b.Flush(context.Background()))
+}
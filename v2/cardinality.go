@@ -0,0 +1,225 @@
+package httpstats
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xstats"
+)
+
+const (
+	defaultCardinalityLimit  = 100
+	defaultCardinalityWindow = time.Hour
+)
+
+// tagValues records the last time each value of a single tag key was seen.
+type tagValues struct {
+	seen   map[string]time.Time
+	oldest time.Time
+}
+
+// cardinalityLimiter tracks the distinct values of each tag key over a sliding
+// window. Once a key has reached the limit of distinct values within the
+// window then any new value is replaced with the overflow token until older
+// values age out of the window.
+type cardinalityLimiter struct {
+	limit  int
+	window time.Duration
+	other  string
+	lock   *sync.Mutex
+	keys   map[string]*tagValues
+	now    func() time.Time
+}
+
+func newCardinalityLimiter(limit int, window time.Duration, other string) *cardinalityLimiter {
+	return &cardinalityLimiter{
+		limit:  limit,
+		window: window,
+		other:  other,
+		lock:   &sync.Mutex{},
+		keys:   make(map[string]*tagValues),
+		now:    time.Now,
+	}
+}
+
+// apply returns the given tags with any overflow values replaced. The input
+// slice is never modified. The keys of any replaced values are returned so
+// that the clamping can be reported.
+func (c *cardinalityLimiter) apply(tags []string) ([]string, []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var now = c.now()
+	var output = tags
+	var clamped []string
+	for offset, tag := range tags {
+		var key, value, found = strings.Cut(tag, ":")
+		if !found || value == c.other || c.allow(key, value, now) {
+			continue
+		}
+		if clamped == nil {
+			output = make([]string, len(tags))
+			copy(output, tags)
+		}
+		output[offset] = fmt.Sprintf("%s:%s", key, c.other)
+		clamped = append(clamped, key)
+	}
+	return output, clamped
+}
+
+// value returns the given value of the key or the overflow token if the key
+// has reached its limit.
+func (c *cardinalityLimiter) value(key string, value string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if value == c.other || c.allow(key, value, c.now()) {
+		return value
+	}
+	return c.other
+}
+
+func (c *cardinalityLimiter) allow(key string, value string, now time.Time) bool {
+	var values, ok = c.keys[key]
+	if !ok {
+		values = &tagValues{seen: make(map[string]time.Time), oldest: now}
+		c.keys[key] = values
+	}
+	if _, ok = values.seen[value]; ok {
+		values.seen[value] = now
+		return true
+	}
+	if len(values.seen) >= c.limit && now.Sub(values.oldest) >= c.window {
+		values.oldest = now
+		for seenValue, seenTime := range values.seen {
+			if now.Sub(seenTime) >= c.window {
+				delete(values.seen, seenValue)
+				continue
+			}
+			if seenTime.Before(values.oldest) {
+				values.oldest = seenTime
+			}
+		}
+	}
+	if len(values.seen) >= c.limit {
+		return false
+	}
+	values.seen[value] = now
+	return true
+}
+
+// cardinalitySender applies a cardinality limit to the tags of all metrics
+// before passing them to the wrapped sender. Each time a value is replaced a
+// counter is emitted with the key of the offending tag.
+type cardinalitySender struct {
+	xstats.Sender
+	limiter     *cardinalityLimiter
+	clampedName string
+	tags        []string
+}
+
+func (s *cardinalitySender) limit(tags []string) []string {
+	var output, clamped = s.limiter.apply(tags)
+	for _, key := range clamped {
+		s.Sender.Count(s.clampedName, 1, append([]string{fmt.Sprintf("tag_key:%s", key)}, s.tags...)...)
+	}
+	return output
+}
+
+func (s *cardinalitySender) Gauge(stat string, value float64, tags ...string) {
+	s.Sender.Gauge(stat, value, s.limit(tags)...)
+}
+func (s *cardinalitySender) Count(stat string, value float64, tags ...string) {
+	s.Sender.Count(stat, value, s.limit(tags)...)
+}
+func (s *cardinalitySender) Histogram(stat string, value float64, tags ...string) {
+	s.Sender.Histogram(stat, value, s.limit(tags)...)
+}
+func (s *cardinalitySender) Timing(stat string, value time.Duration, tags ...string) {
+	s.Sender.Timing(stat, value, s.limit(tags)...)
+}
+func (s *cardinalitySender) Distribution(stat string, value float64, tags ...string) {
+	sendDistribution(s.Sender, stat, value, s.limit(tags)...)
+}
+func (s *cardinalitySender) timingDistribution(stat string, value float64, tags ...string) {
+	sendTimingDistribution(s.Sender, stat, value, s.limit(tags)...)
+}
+func (s *cardinalitySender) sendValues(stat string, values []float64, kind string, tags []string) {
+	sendSamples(s.Sender, stat, values, kind, s.limit(tags))
+}
+
+// useDefaults replaces a limit or window that is not positive with the
+// default value.
+func (c *cardinalityLimiter) useDefaults() {
+	if c.limit < 1 {
+		c.limit = defaultCardinalityLimit
+	}
+	if c.window <= 0 {
+		c.window = defaultCardinalityWindow
+	}
+}
+
+// validateCardinalityLimit checks the settings of a cardinality limit. A
+// window that is not positive would expire every value immediately and so
+// never limit anything.
+func validateCardinalityLimit(limit int, window time.Duration) error {
+	if limit < 1 {
+		return fmt.Errorf("tag cardinality limit must be positive: %d", limit)
+	}
+	if window <= 0 {
+		return fmt.Errorf("tag cardinality window must be positive: %s", window)
+	}
+	return nil
+}
+
+// MiddlewareOptionTagCardinalityLimit restricts the number of distinct values
+// each tag key may have within a sliding window. Once a key has seen limit
+// distinct values within the window then any new value is replaced with the
+// other token. The limit applies to all tags, including the static tags,
+// request tags, and tags generated by the middleware, and to all senders. A
+// counter named service_tag_cardinality_clamped, tagged with the offending
+// tag_key, is emitted each time a value is replaced.
+func MiddlewareOptionTagCardinalityLimit(limit int, window time.Duration, other string) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		if e := validateCardinalityLimit(limit, window); e != nil {
+			return nil, e
+		}
+		m.cardinality = newCardinalityLimiter(limit, window, other)
+		return m, nil
+	}
+}
+
+// MiddlewareOptionTagCardinalityClampedName sets the metric name used to
+// count tag values that were replaced because of the cardinality limit. The
+// default value is service_tag_cardinality_clamped.
+func MiddlewareOptionTagCardinalityClampedName(name string) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.cardinalityClamped = name
+		return m, nil
+	}
+}
+
+// TransportOptionTagCardinalityLimit restricts the number of distinct values
+// each static or request tag key may have within a sliding window. Once a key
+// has seen limit distinct values within the window then any new value is
+// replaced with the other token. A counter named
+// client_tag_cardinality_clamped, tagged with the offending tag_key, is
+// emitted each time a value is replaced. A limit less than one is replaced
+// with the default of 100 and a window that is not positive with the default
+// of one hour when the transport is built.
+func TransportOptionTagCardinalityLimit(limit int, window time.Duration, other string) TransportOption {
+	return func(m *Transport) *Transport {
+		m.cardinality = newCardinalityLimiter(limit, window, other)
+		return m
+	}
+}
+
+// TransportOptionTagCardinalityClampedName sets the metric name used to count
+// tag values that were replaced because of the cardinality limit. The default
+// value is client_tag_cardinality_clamped.
+func TransportOptionTagCardinalityClampedName(name string) TransportOption {
+	return func(m *Transport) *Transport {
+		m.cardinalityClamped = name
+		return m
+	}
+}
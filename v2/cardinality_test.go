@@ -0,0 +1,128 @@
+package httpstats
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/xstats"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func TestCardinalityLimiter(t *testing.T) {
+	var now = time.Now()
+	var limiter = newCardinalityLimiter(2, time.Minute, "other")
+	limiter.now = func() time.Time { return now }
+
+	var input = []string{"user:1", "static:value"}
+	var output, clamped = limiter.apply(input)
+	assert.Equal(t, []string{"user:1", "static:value"}, output)
+	assert.Empty(t, clamped)
+
+	output, clamped = limiter.apply([]string{"user:2", "static:value"})
+	assert.Equal(t, []string{"user:2", "static:value"}, output)
+	assert.Empty(t, clamped)
+
+	now = now.Add(30 * time.Second)
+	output, clamped = limiter.apply([]string{"user:3", "static:value"})
+	assert.Equal(t, []string{"user:other", "static:value"}, output)
+	assert.Equal(t, []string{"user"}, clamped)
+
+	// Values already seen continue to pass through and are refreshed.
+	output, clamped = limiter.apply([]string{"user:1", "untagged"})
+	assert.Equal(t, []string{"user:1", "untagged"}, output)
+	assert.Empty(t, clamped)
+
+	// The second value ages out of the window while the first was refreshed.
+	now = now.Add(45 * time.Second)
+	output, clamped = limiter.apply([]string{"user:3"})
+	assert.Equal(t, []string{"user:3"}, output)
+	assert.Empty(t, clamped)
+	output, clamped = limiter.apply([]string{"user:4"})
+	assert.Equal(t, []string{"user:other"}, output)
+	assert.Equal(t, []string{"user"}, clamped)
+
+	assert.Equal(t, []string{"user:1", "static:value"}, input)
+}
+
+func TestMiddlewareOptionTagCardinalityLimit(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionTag(testName, testName),
+		MiddlewareOptionRequestTag(func(r *http.Request) (string, string) { return "user", r.URL.Query().Get("user") }),
+		MiddlewareOptionTagCardinalityLimit(1, time.Minute, "other"),
+		MiddlewareOptionTagCardinalityClampedName("clamped"),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(fixtureHandler{}).(*Middleware)
+
+	var tags = []interface{}{"server_method:GET", "server_status_code:200", "server_status:ok", "user:1", "test:test"}
+	sender.EXPECT().Timing(m.requestTime, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesIn, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesOut, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesTotal, gomock.Any(), tags...)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?user=1", nil))
+
+	tags = []interface{}{"server_method:GET", "server_status_code:200", "server_status:ok", "user:other", "test:test"}
+	sender.EXPECT().Count("clamped", float64(1), "tag_key:user", "test:test").Times(4)
+	sender.EXPECT().Timing(m.requestTime, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesIn, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesOut, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesTotal, gomock.Any(), tags...)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?user=2", nil))
+}
+
+func TestMiddlewareOptionTagCardinalityLimitInvalid(t *testing.T) {
+	var _, _, e = NewMiddleware(MiddlewareOptionTagCardinalityLimit(0, time.Minute, "other"))
+	assert.Error(t, e)
+	_, _, e = NewMiddleware(MiddlewareOptionTagCardinalityLimit(1, 0, "other"))
+	assert.Error(t, e)
+}
+
+func TestTransportOptionTagCardinalityLimitInvalid(t *testing.T) {
+	var r = NewTransport(TransportOptionTagCardinalityLimit(0, -time.Minute, "other"))(http.DefaultTransport).(*Transport)
+	assert.Equal(t, defaultCardinalityLimit, r.cardinality.limit)
+	assert.Equal(t, defaultCardinalityWindow, r.cardinality.window)
+	r = NewTransport(TransportOptionTagCardinalityLimit(5, time.Minute, "other"))(http.DefaultTransport).(*Transport)
+	assert.Equal(t, 5, r.cardinality.limit)
+	assert.Equal(t, time.Minute, r.cardinality.window)
+}
+
+func TestTransportOptionTagCardinalityLimit(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var result = NewTransport(
+		TransportOptionRequestTag(func(r *http.Request) (string, string) { return "user", r.URL.Query().Get("user") }),
+		TransportOptionTagCardinalityLimit(1, time.Minute, "other"),
+		TransportOptionTagCardinalityClampedName("clamped"),
+	)
+	var r = result(&instanceStoreTransport{}).(*Transport)
+
+	sender.EXPECT().Timing(r.requestTime, gomock.Any(), "user:1", "method:GET", "status_code:200", "status:ok")
+	sender.EXPECT().Histogram(r.bytesIn, gomock.Any(), "user:1")
+	sender.EXPECT().Histogram(r.bytesOut, gomock.Any(), "user:1")
+	sender.EXPECT().Histogram(r.bytesTotal, gomock.Any(), "user:1")
+	var req = httptest.NewRequest(http.MethodGet, "/?user=1", nil).WithContext(xstats.NewContext(context.Background(), sender))
+	var resp, _ = r.RoundTrip(req)
+	resp.Body.Close()
+
+	sender.EXPECT().Count("clamped", float64(1), "tag_key:user")
+	sender.EXPECT().Timing(r.requestTime, gomock.Any(), "user:other", "method:GET", "status_code:200", "status:ok")
+	sender.EXPECT().Histogram(r.bytesIn, gomock.Any(), "user:other")
+	sender.EXPECT().Histogram(r.bytesOut, gomock.Any(), "user:other")
+	sender.EXPECT().Histogram(r.bytesTotal, gomock.Any(), "user:other")
+	req = httptest.NewRequest(http.MethodGet, "/?user=2", nil).WithContext(xstats.NewContext(context.Background(), sender))
+	resp, _ = r.RoundTrip(req)
+	resp.Body.Close()
+}
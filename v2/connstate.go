@@ -0,0 +1,198 @@
+package httpstats
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/xstats"
+)
+
+type connInfo struct {
+	state    http.ConnState
+	opened   time.Time
+	requests int
+}
+
+// connStates are the states, in the order they are reported, of the
+// connections managed by an http.Server.
+var connStates = []http.ConnState{http.StateNew, http.StateActive, http.StateIdle}
+
+// connTracker records the state of connections accepted by an http.Server
+// and periodically emits the number of connections in each state.
+type connTracker struct {
+	stat     xstats.XStater
+	interval time.Duration
+	lock     *sync.Mutex
+	conns    map[net.Conn]*connInfo
+	counts   map[http.ConnState]int64
+	open     string
+	hijacked string
+	lifetime string
+	requests string
+	now      func() time.Time
+	closed   bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// connState records a change in the state of a connection.
+func (c *connTracker) connState(conn net.Conn, state http.ConnState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var info, ok = c.conns[conn]
+	if !ok {
+		info = &connInfo{state: state, opened: c.now()}
+		c.conns[conn] = info
+	} else {
+		c.counts[info.state]--
+		info.state = state
+	}
+	if state == http.StateActive {
+		info.requests++
+	}
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(c.conns, conn)
+		var tag = fmt.Sprintf("conn_end:%s", state)
+		c.stat.Timing(c.lifetime, c.now().Sub(info.opened), tag)
+		c.stat.Histogram(c.requests, float64(info.requests), tag)
+		if state == http.StateHijacked {
+			c.stat.Count(c.hijacked, 1)
+		}
+		return
+	}
+	c.counts[state]++
+}
+
+// flush emits the number of connections in each state.
+func (c *connTracker) flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, state := range connStates {
+		c.stat.Gauge(c.open, float64(c.counts[state]), fmt.Sprintf("conn_state:%s", state))
+	}
+}
+
+func (c *connTracker) run() {
+	defer close(c.done)
+	var ticker = time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flush()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Flush emits the server_connections_open gauges.
+func (c *connTracker) Flush(ctx context.Context) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	c.flush()
+	return nil
+}
+
+// Close stops the periodic emission of the gauges and emits them one last
+// time. Calling Close more than once has no effect.
+func (c *connTracker) Close(ctx context.Context) error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.lock.Unlock()
+	if c.interval > 0 {
+		if e := stopTracker(ctx, c.stop, c.done); e != nil {
+			return e
+		}
+	}
+	c.flush()
+	return nil
+}
+
+// ConnStateOption is used to configure the connection tracker.
+type ConnStateOption func(*connTracker) *connTracker
+
+// ConnStateOptionOpenName sets the name of the gauge used to track the number
+// of connections in each state. The default value is server_connections_open.
+func ConnStateOptionOpenName(name string) ConnStateOption {
+	return func(c *connTracker) *connTracker {
+		c.open = name
+		return c
+	}
+}
+
+// ConnStateOptionHijackedName sets the name of the counter incremented each
+// time a connection is hijacked. The default value is
+// server_connections_hijacked.
+func ConnStateOptionHijackedName(name string) ConnStateOption {
+	return func(c *connTracker) *connTracker {
+		c.hijacked = name
+		return c
+	}
+}
+
+// ConnStateOptionLifetimeName sets the name of the metric used to track the
+// duration of each connection. The default value is
+// server_connection_lifetime.
+func ConnStateOptionLifetimeName(name string) ConnStateOption {
+	return func(c *connTracker) *connTracker {
+		c.lifetime = name
+		return c
+	}
+}
+
+// ConnStateOptionRequestsName sets the name of the metric used to track the
+// number of requests served on each connection. The default value is
+// server_connection_requests.
+func ConnStateOptionRequestsName(name string) ConnStateOption {
+	return func(c *connTracker) *connTracker {
+		c.requests = name
+		return c
+	}
+}
+
+// NewConnState returns a function for use as the http.Server ConnState hook
+// along with a FlushCloser that stops the periodic emission of the gauges.
+// The stat client should be the one returned by NewMiddleware so that the
+// connection metrics share the same tags and senders as the request metrics.
+//
+// On each interval the server_connections_open gauge is emitted for the new,
+// active, and idle states, tagged with conn_state. Hijacked connections are
+// no longer managed by the server so they are counted by the
+// server_connections_hijacked counter instead. When a connection is closed or
+// hijacked the server_connection_lifetime timer and server_connection_requests
+// histogram are emitted, tagged with conn_end. If the interval is less than
+// or equal to zero then the gauges are only emitted by Flush and Close.
+func NewConnState(stat xstats.XStater, interval time.Duration, options ...ConnStateOption) (func(net.Conn, http.ConnState), FlushCloser) {
+	var c = &connTracker{
+		stat:     stat,
+		interval: interval,
+		lock:     &sync.Mutex{},
+		conns:    make(map[net.Conn]*connInfo),
+		counts:   make(map[http.ConnState]int64),
+		open:     "server_connections_open",
+		hijacked: "server_connections_hijacked",
+		lifetime: "server_connection_lifetime",
+		requests: "server_connection_requests",
+		now:      time.Now,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, option := range options {
+		c = option(c)
+	}
+	if c.interval > 0 {
+		go c.run()
+	}
+	return c.connState, c
+}
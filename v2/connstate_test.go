@@ -0,0 +1,78 @@
+package httpstats
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rs/xstats"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func expectConnGauges(sender *MockXStater, newConns float64, active float64, idle float64) {
+	gomock.InOrder(
+		sender.EXPECT().Gauge("open", newConns, "conn_state:new", "test:test"),
+		sender.EXPECT().Gauge("open", active, "conn_state:active", "test:test"),
+		sender.EXPECT().Gauge("open", idle, "conn_state:idle", "test:test"),
+	)
+}
+
+func TestNewConnState(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var stat = xstats.New(sender)
+	stat.AddTags("test:test")
+	var hook, closer = NewConnState(
+		stat,
+		0,
+		ConnStateOptionOpenName("open"),
+		ConnStateOptionHijackedName("hijacked"),
+		ConnStateOptionLifetimeName("lifetime"),
+		ConnStateOptionRequestsName("requests"),
+	)
+	var first, second = net.Pipe()
+	defer first.Close()
+	defer second.Close()
+
+	hook(first, http.StateNew)
+	hook(second, http.StateNew)
+	hook(first, http.StateActive)
+	hook(first, http.StateIdle)
+	hook(first, http.StateActive)
+	expectConnGauges(sender, 1, 1, 0)
+	assert.NoError(t, closer.Flush(context.Background()))
+
+	gomock.InOrder(
+		sender.EXPECT().Timing("lifetime", gomock.Any(), "conn_end:closed", "test:test"),
+		sender.EXPECT().Histogram("requests", float64(2), "conn_end:closed", "test:test"),
+	)
+	hook(first, http.StateClosed)
+
+	hook(second, http.StateActive)
+	gomock.InOrder(
+		sender.EXPECT().Timing("lifetime", gomock.Any(), "conn_end:hijacked", "test:test"),
+		sender.EXPECT().Histogram("requests", float64(1), "conn_end:hijacked", "test:test"),
+		sender.EXPECT().Count("hijacked", float64(1), "test:test"),
+	)
+	hook(second, http.StateHijacked)
+
+	expectConnGauges(sender, 0, 0, 0)
+	assert.NoError(t, closer.Close(context.Background()))
+	assert.NoError(t, closer.Close(context.Background()))
+}
+
+func TestNewConnStateInterval(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	sender.EXPECT().Gauge("server_connections_open", gomock.Any(), gomock.Any()).MinTimes(6)
+	var _, closer = NewConnState(xstats.New(sender), time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, closer.Close(context.Background()))
+}
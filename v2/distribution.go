@@ -0,0 +1,239 @@
+package httpstats
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/xstats"
+)
+
+// distributionSuffix is appended to the metric name of a distribution when
+// it is emitted alongside the legacy timer or histogram.
+const distributionSuffix = "_distribution"
+
+// timingDistributionKind is the sample kind of a distribution of durations in
+// milliseconds. It is written as a plain distribution but senders that do not
+// support distributions receive a timer, rather than a histogram, so that the
+// values keep their unit.
+const timingDistributionKind = "dms"
+
+// DistributionSender is implemented by senders that support the datadog
+// distribution metric type. Distributions are aggregated by the datadog
+// backend rather than the local agent so their percentiles are accurate
+// across all hosts.
+type DistributionSender interface {
+	Distribution(stat string, value float64, tags ...string)
+}
+
+// timingDistributionSender is implemented by senders that wrap another so
+// that distributions of durations reach the wrapped sender as such.
+type timingDistributionSender interface {
+	timingDistribution(stat string, value float64, tags ...string)
+}
+
+// sendDistribution emits a distribution if the sender supports them and a
+// histogram otherwise. The values of a MultiSender are checked individually.
+func sendDistribution(sender xstats.Sender, stat string, value float64, tags ...string) {
+	switch s := sender.(type) {
+	case DistributionSender:
+		s.Distribution(stat, value, tags...)
+	case xstats.MultiSender:
+		for _, ss := range s {
+			sendDistribution(ss, stat, value, tags...)
+		}
+	default:
+		sender.Histogram(stat, value, tags...)
+	}
+}
+
+// sendTimingDistribution emits a distribution of a duration, given in
+// milliseconds, if the sender supports them and a timer otherwise.
+func sendTimingDistribution(sender xstats.Sender, stat string, value float64, tags ...string) {
+	switch s := sender.(type) {
+	case timingDistributionSender:
+		s.timingDistribution(stat, value, tags...)
+	case DistributionSender:
+		s.Distribution(stat, value, tags...)
+	case xstats.MultiSender:
+		for _, ss := range s {
+			sendTimingDistribution(ss, stat, value, tags...)
+		}
+	default:
+		sender.Timing(stat, time.Duration(value*float64(time.Millisecond)), tags...)
+	}
+}
+
+// distributionStater is an xstats.XStater that can also emit distributions
+// to the sender it wraps. The tags of the XStater are applied to each
+// distribution.
+type distributionStater struct {
+	xstats.XStater
+	sender xstats.Sender
+}
+
+func newDistributionStater(sender xstats.Sender) *distributionStater {
+	return &distributionStater{XStater: xstats.New(sender), sender: sender}
+}
+
+func (s *distributionStater) allTags(tags []string) []string {
+	var output = make([]string, 0, len(tags)+len(s.XStater.GetTags()))
+	output = append(output, tags...)
+	return append(output, s.XStater.GetTags()...)
+}
+
+func (s *distributionStater) Distribution(stat string, value float64, tags ...string) {
+	sendDistribution(s.sender, stat, value, s.allTags(tags)...)
+}
+
+func (s *distributionStater) timingDistribution(stat string, value float64, tags ...string) {
+	sendTimingDistribution(s.sender, stat, value, s.allTags(tags)...)
+}
+
+// Copy implements the xstats.Copier interface.
+func (s *distributionStater) Copy() xstats.XStater {
+	return &distributionStater{XStater: xstats.Copy(s.XStater), sender: s.sender}
+}
+
+// Scope implements the xstats.Scoper interface. Scoped clients do not emit
+// distributions.
+func (s *distributionStater) Scope(scope string, scopes ...string) xstats.XStater {
+	return xstats.Scope(s.XStater, scope, scopes...)
+}
+
+// newStatHandler injects a per request stat client, that supports
+// distributions, in the context of each request.
+func newStatHandler(sender xstats.Sender) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(xstats.NewContext(r.Context(), newDistributionStater(sender))))
+		})
+	}
+}
+
+// distributions emits selected timers and histograms as distributions. In
+// migration mode both the legacy metric and the distribution are emitted.
+type distributions struct {
+	migration bool
+	custom    []string
+	names     map[string]string
+}
+
+// resolve maps each legacy metric name to the name of its distribution. The
+// custom names, if any, are given in the same order as the metrics.
+func (d *distributions) resolve(metrics ...string) {
+	d.names = make(map[string]string, len(metrics))
+	for offset, metric := range metrics {
+		var name = metric
+		if d.migration {
+			name = metric + distributionSuffix
+		}
+		if offset < len(d.custom) && d.custom[offset] != "" {
+			name = d.custom[offset]
+		}
+		d.names[metric] = name
+	}
+}
+
+func (d *distributions) lookup(stat string) (string, bool) {
+	if d == nil {
+		return "", false
+	}
+	var name, ok = d.names[stat]
+	return name, ok
+}
+
+// timing emits the duration as a timer, a distribution in milliseconds, or
+// both depending on the configuration. A nil distributions emits a timer.
+func (d *distributions) timing(stat xstats.XStater, name string, value time.Duration, tags []string) {
+	var distribution, ok = d.lookup(name)
+	if !ok || d.migration {
+		stat.Timing(name, value, tags...)
+	}
+	if ok {
+		sendTimingDistribution(stat, distribution, value.Seconds()*1000, tags...)
+	}
+}
+
+// histogram emits the value as a histogram, a distribution, or both
+// depending on the configuration. A nil distributions emits a histogram.
+func (d *distributions) histogram(stat xstats.XStater, name string, value float64, tags []string) {
+	var distribution, ok = d.lookup(name)
+	if !ok || d.migration {
+		stat.Histogram(name, value, tags...)
+	}
+	if ok {
+		sendDistribution(stat, distribution, value, tags...)
+	}
+}
+
+// MiddlewareOptionDistributions emits service_time and the byte metrics as
+// datadog distributions rather than as timers and histograms. Senders that do
+// not support distributions receive the timer and histograms instead.
+func MiddlewareOptionDistributions() MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.distributions = &distributions{}
+		return m, nil
+	}
+}
+
+// MiddlewareOptionDistributionMigration emits service_time and the byte
+// metrics both under their usual names and types and as distributions. The
+// distributions are named after the metric with a _distribution suffix, such
+// as service_time_distribution, unless renamed with
+// MiddlewareOptionDistributionNames.
+func MiddlewareOptionDistributionMigration() MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.distributions = &distributions{migration: true}
+		return m, nil
+	}
+}
+
+// MiddlewareOptionDistributionNames sets the names of the distributions
+// emitted for the request time and the bytes received, returned, and in total.
+// An empty name keeps the default. This option must be given after
+// MiddlewareOptionDistributions or MiddlewareOptionDistributionMigration.
+func MiddlewareOptionDistributionNames(requestTimeName string, bytesInName string, bytesOutName string, bytesTotalName string) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		if m.distributions == nil {
+			return nil, fmt.Errorf("distributions are not enabled")
+		}
+		m.distributions.custom = []string{requestTimeName, bytesInName, bytesOutName, bytesTotalName}
+		return m, nil
+	}
+}
+
+// TransportOptionDistributions emits client_request_time and the byte metrics
+// as datadog distributions rather than as timers and histograms. The stat
+// client of the request must support distributions, as those created by the
+// Middleware do, otherwise the timer and histograms are emitted instead.
+func TransportOptionDistributions() TransportOption {
+	return func(m *Transport) *Transport {
+		m.distributions = &distributions{}
+		return m
+	}
+}
+
+// TransportOptionDistributionMigration emits client_request_time and the byte
+// metrics both under their usual names and types and as distributions. The
+// distributions are named after the metric with a _distribution suffix, such
+// as client_request_time_distribution, unless renamed with
+// TransportOptionDistributionNames.
+func TransportOptionDistributionMigration() TransportOption {
+	return func(m *Transport) *Transport {
+		m.distributions = &distributions{migration: true}
+		return m
+	}
+}
+
+// TransportOptionDistributionNames sets the names of the distributions
+// emitted for the request time and the bytes received, sent, and in total. An
+// empty name keeps the default. The names have no effect unless
+// TransportOptionDistributions or TransportOptionDistributionMigration is also
+// given.
+func TransportOptionDistributionNames(requestTimeName string, bytesInName string, bytesOutName string, bytesTotalName string) TransportOption {
+	return func(m *Transport) *Transport {
+		m.distributionNames = []string{requestTimeName, bytesInName, bytesOutName, bytesTotalName}
+		return m
+	}
+}
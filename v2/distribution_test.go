@@ -0,0 +1,189 @@
+package httpstats
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/xstats"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+// metricKinds returns the name and type, such as service_time|ms, of each
+// metric written by a StatsdSender.
+func metricKinds(w *packetWriter) []string {
+	var kinds []string
+	for _, packet := range w.written() {
+		for _, line := range strings.Split(strings.TrimSuffix(packet, "\n"), "\n") {
+			var name, rest, _ = strings.Cut(line, ":")
+			var _, kind, _ = strings.Cut(rest, "|")
+			kind, _, _ = strings.Cut(kind, "|")
+			kinds = append(kinds, name+"|"+kind)
+		}
+	}
+	return kinds
+}
+
+func TestSendDistribution(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var fallback = NewMockSender(ctrl)
+	fallback.EXPECT().Histogram("stat", 2.5, "a:b")
+	var w = newPacketWriter()
+	var statsd = NewStatsdSender(w, 1024, 0)
+
+	sendDistribution(xstats.MultiSender{statsd, fallback}, "stat", 2.5, "a:b")
+	assert.NoError(t, statsd.Flush(context.Background()))
+	assert.Equal(t, []string{"stat:2.500000|d|#a:b\n"}, w.written())
+}
+
+func TestSendTimingDistribution(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var fallback = NewMockSender(ctrl)
+	fallback.EXPECT().Timing("stat", 2500*time.Microsecond, "a:b")
+	var w = newPacketWriter()
+	var statsd = NewStatsdSender(w, 1024, 0)
+
+	sendTimingDistribution(newDistributionStater(xstats.MultiSender{statsd, fallback}), "stat", 2.5, "a:b")
+	assert.NoError(t, statsd.Flush(context.Background()))
+	assert.Equal(t, []string{"stat:2.500000|d|#a:b\n"}, w.written())
+}
+
+func TestRollupStatWrapperDistribution(t *testing.T) {
+	var w = newPacketWriter()
+	var statsd = NewStatsdSender(w, 1024, 0)
+	var rollup = &rollupStatWrapper{Sender: statsd, globals: []string{"region", "host"}}
+
+	sendDistribution(rollup, "stat", 1, "region:us-west-2")
+	assert.NoError(t, statsd.Flush(context.Background()))
+	assert.Equal(t, []string{"stat:1.000000|d|#region:us-west-2\n"}, w.written())
+}
+
+func TestMiddlewareOptionDistributions(t *testing.T) {
+	var w = newPacketWriter()
+	var statsd = NewStatsdSender(w, 1<<15, 0)
+	var result, _, e = NewMiddleware(middlewareOptionSender(statsd), MiddlewareOptionDistributions())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	result(fixtureHandler{}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.NoError(t, statsd.Flush(context.Background()))
+	var kinds = metricKinds(w)
+	assert.Contains(t, kinds, "service_time|d")
+	assert.Contains(t, kinds, "service_bytes_received|d")
+	assert.Contains(t, kinds, "service_bytes_returned|d")
+	assert.Contains(t, kinds, "service_bytes_total|d")
+	assert.NotContains(t, kinds, "service_time|ms")
+}
+
+func TestMiddlewareOptionDistributionsPrometheus(t *testing.T) {
+	var sender = NewPrometheusSender()
+	var result, _, e = NewMiddleware(MiddlewareOptionPrometheusSender(sender), MiddlewareOptionDistributions())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	result(fixtureHandler{}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var recorder = httptest.NewRecorder()
+	sender.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var body, _ = io.ReadAll(recorder.Body)
+	var bounds []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "service_time_bucket{") {
+			var _, bound, _ = strings.Cut(line, "le=")
+			bounds = append(bounds, strings.Fields(bound)[0])
+		}
+	}
+	// The request time keeps the timer buckets, in seconds, rather than the
+	// byte buckets of a histogram.
+	assert.Contains(t, bounds, `"0.005"}`)
+	assert.NotContains(t, bounds, `"64"}`)
+}
+
+func TestMiddlewareOptionDistributionMigration(t *testing.T) {
+	var w = newPacketWriter()
+	var statsd = NewStatsdSender(w, 1<<15, 0)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(statsd),
+		MiddlewareOptionRequestTimeName("request_time"),
+		MiddlewareOptionDistributionMigration(),
+		MiddlewareOptionDistributionNames("request_time_dist", "", "", ""),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	result(fixtureHandler{}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.NoError(t, statsd.Flush(context.Background()))
+	var kinds = metricKinds(w)
+	assert.Contains(t, kinds, "request_time|ms")
+	assert.Contains(t, kinds, "request_time_dist|d")
+	assert.Contains(t, kinds, "service_bytes_received|h")
+	assert.Contains(t, kinds, "service_bytes_received_distribution|d")
+}
+
+func TestMiddlewareOptionDistributionNamesNotEnabled(t *testing.T) {
+	var _, _, e = NewMiddleware(MiddlewareOptionDistributionNames("a", "b", "c", "d"))
+	assert.Error(t, e)
+}
+
+func TestTransportOptionDistributionMigration(t *testing.T) {
+	var w = newPacketWriter()
+	var statsd = NewStatsdSender(w, 1<<15, 0)
+	var stat = newDistributionStater(statsd)
+	stat.AddTags("service:test")
+	var transport = NewTransport(TransportOptionDistributionMigration())(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewBufferString(`body`))}, nil
+	}))
+	var r = httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	r = r.WithContext(xstats.NewContext(r.Context(), xstats.Copy(stat)))
+	var resp, e = transport.RoundTrip(r)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	_, _ = io.ReadAll(resp.Body)
+	assert.NoError(t, resp.Body.Close())
+	assert.NoError(t, statsd.Flush(context.Background()))
+	var kinds = metricKinds(w)
+	assert.Contains(t, kinds, "client_request_time|ms")
+	assert.Contains(t, kinds, "client_request_time_distribution|d")
+	assert.Contains(t, kinds, "client_request_bytes_received_distribution|d")
+	assert.Contains(t, kinds, "client_request_bytes_sent|h")
+	assert.Contains(t, kinds, "client_request_bytes_sent_distribution|d")
+	assert.Contains(t, kinds, "client_request_bytes_total_distribution|d")
+	assert.Contains(t, w.written()[0], "|d|#")
+	assert.Contains(t, w.written()[0], "service:test")
+}
+
+func TestTransportOptionDistributionNames(t *testing.T) {
+	// The names apply regardless of the order of the options.
+	var r = NewTransport(
+		TransportOptionDistributionNames("request_time_dist", "", "", ""),
+		TransportOptionDistributionMigration(),
+	)(http.DefaultTransport).(*Transport)
+	assert.Equal(t, "request_time_dist", r.distributions.names["client_request_time"])
+	assert.Equal(t, "client_request_bytes_received_distribution", r.distributions.names["client_request_bytes_received"])
+
+	r = NewTransport(TransportOptionDistributionNames("a", "b", "c", "d"))(http.DefaultTransport).(*Transport)
+	assert.Nil(t, r.distributions)
+}
+
+func TestTransportOptionDistributionsFallback(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+	var stat = NewMockXStater(ctrl)
+	stat.EXPECT().Timing("client_request_time", gomock.Any(), gomock.Any())
+	stat.EXPECT().Histogram("client_request_bytes_received", gomock.Any(), gomock.Any())
+	stat.EXPECT().Timing(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	var transport = NewTransport(TransportOptionDistributions())(statusTransport(http.StatusOK))
+	var r = httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	r = r.WithContext(xstats.NewContext(r.Context(), stat))
+	var _, e = transport.RoundTrip(r)
+	assert.NoError(t, e)
+}
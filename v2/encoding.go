@@ -0,0 +1,310 @@
+package httpstats
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/xstats"
+)
+
+const (
+	encodingIdentity = "identity"
+	encodingNone     = "none"
+
+	serverRequestEncodingTagName  = "server_request_encoding"
+	serverResponseEncodingTagName = "server_response_encoding"
+	requestEncodingTagName        = "request_encoding"
+	responseEncodingTagName       = "response_encoding"
+)
+
+// contentEncoding holds the configuration of content encoding tracking. The
+// decode value enables the decoding of response bodies by the Middleware.
+type contentEncoding struct {
+	decodedName string
+	ratioName   string
+	decode      bool
+}
+
+// record emits the decoded size of a body along with, for encoded bodies, the
+// ratio of the decoded size to the size on the wire.
+func (c *contentEncoding) record(stat xstats.XStater, wire int, decoded int, encoded bool, tags []string) {
+	stat.Histogram(c.decodedName, float64(decoded), tags...)
+	if encoded && wire > 0 {
+		stat.Histogram(c.ratioName, float64(decoded)/float64(wire), tags...)
+	}
+}
+
+// contentEncodingName returns a tag safe name for the content encoding of a
+// message. Multiple encodings are joined with a plus sign.
+func contentEncodingName(h http.Header) string {
+	var value = strings.TrimSpace(h.Get("Content-Encoding"))
+	if value == "" {
+		return encodingIdentity
+	}
+	var parts = strings.Split(value, ",")
+	for offset, part := range parts {
+		parts[offset] = strings.ToLower(strings.TrimSpace(part))
+	}
+	return strings.Join(parts, "+")
+}
+
+// encodingTags returns a copy of the tags with the given encodings added.
+func encodingTags(tags []string, requestName string, requestEncoding string, responseName string, responseEncoding string) []string {
+	var result = make([]string, 0, len(tags)+2)
+	result = append(result, tags...)
+	return append(result,
+		fmt.Sprintf("%s:%s", requestName, requestEncoding),
+		fmt.Sprintf("%s:%s", responseName, responseEncoding),
+	)
+}
+
+// supportedEncoding returns true if content of the given encoding can be
+// decoded.
+func supportedEncoding(encoding string) bool {
+	switch encoding {
+	case encodingIdentity, "gzip", "x-gzip", "deflate":
+		return true
+	}
+	return false
+}
+
+// newDecoder returns a reader that decodes content of a supported encoding
+// other than identity.
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	if encoding == "deflate" {
+		return zlib.NewReader(r)
+	}
+	return gzip.NewReader(r)
+}
+
+// decodingCounter is given the response body written by a handler and counts
+// the number of bytes it decodes to. The encoding is determined from the
+// response headers on the first write.
+type decodingCounter struct {
+	header   http.Header
+	once     *sync.Once
+	encoding string
+	writer   *io.PipeWriter
+	decoded  int64
+	failed   bool
+	done     chan struct{}
+}
+
+func newDecodingCounter(header http.Header) *decodingCounter {
+	return &decodingCounter{
+		header: header,
+		once:   &sync.Once{},
+		done:   make(chan struct{}),
+	}
+}
+
+func (d *decodingCounter) start() {
+	d.once.Do(func() {
+		d.encoding = contentEncodingName(d.header)
+		if d.encoding == encodingIdentity || !supportedEncoding(d.encoding) {
+			close(d.done)
+			return
+		}
+		var reader, writer = io.Pipe()
+		d.writer = writer
+		go d.decode(reader)
+	})
+}
+
+func (d *decodingCounter) decode(reader *io.PipeReader) {
+	defer close(d.done)
+	var decoder, e = newDecoder(d.encoding, reader)
+	if e == nil {
+		d.decoded, e = io.Copy(ioutil.Discard, decoder)
+	}
+	d.failed = e != nil
+	// Anything left is drained so that writes from the handler never block.
+	_, _ = io.Copy(ioutil.Discard, reader)
+}
+
+// Write never fails so that it can be used with writerProxy.Tee.
+func (d *decodingCounter) Write(p []byte) (int, error) {
+	d.start()
+	if d.writer != nil {
+		_, _ = d.writer.Write(p)
+	}
+	return len(p), nil
+}
+
+// close stops decoding. It is safe to call more than once.
+func (d *decodingCounter) close() {
+	d.start()
+	if d.writer != nil {
+		_ = d.writer.Close()
+	}
+}
+
+// finish returns the decoded size of a body that was written as wire bytes
+// and whether the body was encoded. The ok value is false if the body could
+// not be decoded.
+func (d *decodingCounter) finish(wire int) (decoded int, encoded bool, ok bool) {
+	d.close()
+	<-d.done
+	switch {
+	case d.encoding == encodingIdentity:
+		return wire, false, true
+	case d.writer == nil || d.failed:
+		return 0, true, false
+	}
+	return int(d.decoded), true, true
+}
+
+// decodingReadCloser decompresses a response body requested by the Transport
+// while counting the compressed bytes read from the wire.
+type decodingReadCloser struct {
+	body    io.ReadCloser
+	wire    *countingReader
+	decoder io.ReadCloser
+	err     error
+}
+
+func newDecodingReadCloser(body io.ReadCloser) *decodingReadCloser {
+	return &decodingReadCloser{
+		body: body,
+		wire: &countingReader{Reader: body, count: new(int64)},
+	}
+}
+
+func (d *decodingReadCloser) Read(p []byte) (int, error) {
+	// The decoder is created lazily because it reads the gzip header.
+	if d.decoder == nil && d.err == nil {
+		d.decoder, d.err = gzip.NewReader(d.wire)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.decoder.Read(p)
+}
+
+func (d *decodingReadCloser) Close() error {
+	return d.body.Close()
+}
+
+func (d *decodingReadCloser) wireBytes() int {
+	return int(atomic.LoadInt64(d.wire.count))
+}
+
+// requestCompression returns a copy of the request that asks for a gzip
+// response if the http.Transport would otherwise have done so itself. The
+// Transport then decompresses the response so that both sizes are known.
+func requestCompression(next http.RoundTripper, r *http.Request) (*http.Request, bool) {
+	var transport, ok = next.(*http.Transport)
+	if !ok || transport.DisableCompression {
+		return r, false
+	}
+	if r.Header.Get("Accept-Encoding") != "" || r.Header.Get("Range") != "" || r.Method == http.MethodHead {
+		return r, false
+	}
+	var compressed = r.WithContext(r.Context())
+	compressed.Header = r.Header.Clone()
+	if compressed.Header == nil {
+		compressed.Header = http.Header{}
+	}
+	compressed.Header.Set("Accept-Encoding", "gzip")
+	return compressed, true
+}
+
+// decompressResponse replaces the body of a gzip response to a request made
+// by requestCompression in the same way as the http.Transport.
+func decompressResponse(resp *http.Response) *decodingReadCloser {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+	var body = newDecodingReadCloser(resp.Body)
+	resp.Body = body
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return body
+}
+
+// MiddlewareOptionContentEncoding tags the byte histograms with the
+// server_request_encoding and server_response_encoding of the request. The
+// encodings are identity if no Content-Encoding header is present.
+func MiddlewareOptionContentEncoding() MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.contentEncoding = &contentEncoding{
+			decodedName: "service_bytes_returned_decoded",
+			ratioName:   "service_compression_ratio",
+		}
+		return m, nil
+	}
+}
+
+// MiddlewareOptionContentDecoding emits a service_bytes_returned_decoded
+// histogram of the size of the content of responses that use the gzip or
+// deflate encodings, or no encoding, along with a service_compression_ratio
+// histogram of the decoded size divided by the size written for the encoded
+// responses. Encoded responses are decompressed by a separate goroutine as
+// they are written which costs as much CPU as the client spends decoding
+// them. This option must be given after MiddlewareOptionContentEncoding.
+func MiddlewareOptionContentDecoding() MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		if m.contentEncoding == nil {
+			return nil, fmt.Errorf("content encoding is not enabled")
+		}
+		m.contentEncoding.decode = true
+		return m, nil
+	}
+}
+
+// MiddlewareOptionContentEncodingNames sets the metric names used for the
+// decoded response size and compression ratio. The default values are
+// service_bytes_returned_decoded and service_compression_ratio. This option
+// must be given after MiddlewareOptionContentEncoding.
+func MiddlewareOptionContentEncodingNames(decodedName string, ratioName string) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		if m.contentEncoding == nil {
+			return nil, fmt.Errorf("content encoding is not enabled")
+		}
+		m.contentEncoding.decodedName = decodedName
+		m.contentEncoding.ratioName = ratioName
+		return m, nil
+	}
+}
+
+// TransportOptionContentEncoding tags the byte histograms with the
+// request_encoding and response_encoding of the request. The response encoding
+// is none if no response was received. If the wrapped http.RoundTripper is an
+// *http.Transport that would transparently decompress the response then the
+// Transport requests and decompresses gzip responses itself so that the byte
+// histograms record the size on the wire. The Accept-Encoding header added to
+// do so is not counted by TransportOptionHeaderSizes, as the one added by the
+// http.Transport is not. In that case, and for responses without an encoding,
+// a client_request_bytes_received_decoded histogram of the decompressed size
+// is also emitted along with, for the decompressed responses, a
+// client_compression_ratio histogram of the decompressed size divided by the
+// size on the wire.
+func TransportOptionContentEncoding() TransportOption {
+	return func(m *Transport) *Transport {
+		m.contentEncoding = &contentEncoding{
+			decodedName: "client_request_bytes_received_decoded",
+			ratioName:   "client_compression_ratio",
+		}
+		return m
+	}
+}
+
+// TransportOptionContentEncodingNames sets the metric names used for the
+// decoded response size and compression ratio. The default values are
+// client_request_bytes_received_decoded and client_compression_ratio. The
+// names have no effect unless TransportOptionContentEncoding is also given.
+func TransportOptionContentEncodingNames(decodedName string, ratioName string) TransportOption {
+	return func(m *Transport) *Transport {
+		m.encodingNames = []string{decodedName, ratioName}
+		return m
+	}
+}
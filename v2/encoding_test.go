@@ -0,0 +1,226 @@
+package httpstats
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/xstats"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+var encodingFixture = strings.Repeat("compressible content ", 100)
+
+func gzipFixture(t *testing.T) []byte {
+	var buf = &bytes.Buffer{}
+	var writer = gzip.NewWriter(buf)
+	_, _ = writer.Write([]byte(encodingFixture))
+	if e := writer.Close(); e != nil {
+		t.Fatal(e.Error())
+	}
+	return buf.Bytes()
+}
+
+func TestContentEncodingName(t *testing.T) {
+	assert.Equal(t, "identity", contentEncodingName(http.Header{}))
+	assert.Equal(t, "gzip", contentEncodingName(http.Header{"Content-Encoding": []string{"GZIP"}}))
+	assert.Equal(t, "deflate+br", contentEncodingName(http.Header{"Content-Encoding": []string{"deflate, br"}}))
+}
+
+func TestDecodingCounter(t *testing.T) {
+	var compressed = gzipFixture(t)
+	var counter = newDecodingCounter(http.Header{"Content-Encoding": []string{"gzip"}})
+	_, _ = counter.Write(compressed[:10])
+	_, _ = counter.Write(compressed[10:])
+	var decoded, encoded, ok = counter.finish(len(compressed))
+	assert.True(t, ok)
+	assert.True(t, encoded)
+	assert.Equal(t, len(encodingFixture), decoded)
+
+	var buf = &bytes.Buffer{}
+	var writer = zlib.NewWriter(buf)
+	_, _ = writer.Write([]byte(encodingFixture))
+	_ = writer.Close()
+	counter = newDecodingCounter(http.Header{"Content-Encoding": []string{"deflate"}})
+	_, _ = counter.Write(buf.Bytes())
+	decoded, _, ok = counter.finish(buf.Len())
+	assert.True(t, ok)
+	assert.Equal(t, len(encodingFixture), decoded)
+
+	counter = newDecodingCounter(http.Header{})
+	_, _ = counter.Write([]byte("plain"))
+	decoded, encoded, ok = counter.finish(5)
+	assert.True(t, ok)
+	assert.False(t, encoded)
+	assert.Equal(t, 5, decoded)
+
+	counter = newDecodingCounter(http.Header{"Content-Encoding": []string{"br"}})
+	_, _ = counter.Write([]byte("brotli"))
+	_, _, ok = counter.finish(6)
+	assert.False(t, ok)
+
+	counter = newDecodingCounter(http.Header{"Content-Encoding": []string{"gzip"}})
+	_, _ = counter.Write([]byte("not gzip content"))
+	_, _ = counter.Write([]byte("written after the failure"))
+	_, _, ok = counter.finish(41)
+	assert.False(t, ok)
+}
+
+func TestMiddlewareOptionContentEncoding(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var compressed = gzipFixture(t)
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionContentEncoding(),
+		MiddlewareOptionContentDecoding(),
+		MiddlewareOptionContentEncodingNames("decoded", "ratio"),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(compressed)
+	})).(*Middleware)
+
+	var tags = []interface{}{"server_method:GET", "server_status_code:200", "server_status:ok"}
+	var byteTags = append(tags, "server_request_encoding:identity", "server_response_encoding:gzip")
+	sender.EXPECT().Timing(m.requestTime, gomock.Any(), tags...)
+	sender.EXPECT().Timing(m.timeToHeaders, gomock.Any(), tags...)
+	sender.EXPECT().Timing(m.timeToFirstByte, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesIn, float64(0), byteTags...)
+	sender.EXPECT().Histogram(m.bytesOut, float64(len(compressed)), byteTags...)
+	sender.EXPECT().Histogram(m.bytesTotal, float64(len(compressed)), byteTags...)
+	sender.EXPECT().Histogram("decoded", float64(len(encodingFixture)), byteTags...)
+	sender.EXPECT().Histogram("ratio", float64(len(encodingFixture))/float64(len(compressed)), byteTags...)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	_, _, e = NewMiddleware(MiddlewareOptionContentEncodingNames("decoded", "ratio"))
+	assert.Error(t, e)
+	_, _, e = NewMiddleware(MiddlewareOptionContentDecoding())
+	assert.Error(t, e)
+}
+
+func TestMiddlewareOptionContentDecodingIdentity(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionContentEncoding(),
+		MiddlewareOptionContentDecoding(),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(encodingFixture))
+	})).(*Middleware)
+
+	// Identity responses report their size but no compression ratio.
+	sender.EXPECT().Timing(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	sender.EXPECT().Histogram(gomock.Not("service_compression_ratio"), gomock.Any(), gomock.Any()).Times(3)
+	sender.EXPECT().Histogram("service_bytes_returned_decoded", float64(len(encodingFixture)), gomock.Any())
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestMiddlewareOptionContentEncodingWithoutDecoding(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var compressed = gzipFixture(t)
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(middlewareOptionSender(sender), MiddlewareOptionContentEncoding())
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(compressed)
+	})).(*Middleware)
+
+	sender.EXPECT().Timing(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	sender.EXPECT().Histogram(gomock.Any(), gomock.Any(), gomock.Any()).Times(3)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestTransportOptionContentEncoding(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var compressed = gzipFixture(t)
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(compressed)
+	}))
+	defer server.Close()
+
+	var sender, recorder = newStreamRecorder(ctrl)
+	var transport = &http.Transport{}
+	defer transport.CloseIdleConnections()
+	var client = &http.Client{Transport: NewTransport(TransportOptionContentEncoding(), TransportOptionHeaderSizes())(transport)}
+	var req, _ = http.NewRequest(http.MethodGet, server.URL, nil)
+	req = req.WithContext(xstats.NewContext(context.Background(), xstats.New(sender)))
+	var resp, e = client.Do(req)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Empty(t, req.Header.Get("Accept-Encoding"))
+	assert.True(t, resp.Uncompressed)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, encodingFixture, string(body))
+
+	assert.Equal(t, float64(len(compressed)), recorder.value("client_request_bytes_sent"))
+	assert.Equal(t, float64(len(encodingFixture)), recorder.value("client_request_bytes_received_decoded"))
+	assert.Equal(t, float64(len(encodingFixture))/float64(len(compressed)), recorder.value("client_compression_ratio"))
+	assert.Equal(t, []string{"request_encoding:identity", "response_encoding:gzip"}, recorder.tagsOf("client_request_bytes_sent"))
+	assert.Equal(t, []string{"request_encoding:identity", "response_encoding:gzip"}, recorder.tagsOf("client_request_bytes_received"))
+	// Only the Host header is counted and not the added Accept-Encoding.
+	assert.Equal(t, float64(1), recorder.value("client_request_header_fields"))
+}
+
+func TestTransportOptionContentEncodingNames(t *testing.T) {
+	// The names apply regardless of the order of the options.
+	var r = NewTransport(
+		TransportOptionContentEncodingNames("decoded", "ratio"),
+		TransportOptionContentEncoding(),
+	)(http.DefaultTransport).(*Transport)
+	assert.Equal(t, "decoded", r.contentEncoding.decodedName)
+	assert.Equal(t, "ratio", r.contentEncoding.ratioName)
+
+	r = NewTransport(TransportOptionContentEncodingNames("decoded", "ratio"))(http.DefaultTransport).(*Transport)
+	assert.Nil(t, r.contentEncoding)
+}
+
+func TestTransportOptionContentEncodingError(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var r = NewTransport(
+		TransportOptionContentEncoding(),
+		TransportOptionContentEncodingNames("decoded", "ratio"),
+	)(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		assert.Empty(t, r.Header.Get("Accept-Encoding"))
+		return nil, context.Canceled
+	}))
+	sender.EXPECT().Timing("client_request_time", gomock.Any(), "method:GET", "status_code:499", "status:error")
+	sender.EXPECT().Histogram("client_request_bytes_received", float64(0), "request_encoding:identity", "response_encoding:none")
+	var req = httptest.NewRequest(http.MethodGet, "/", nil).WithContext(xstats.NewContext(context.Background(), xstats.New(sender)))
+	var _, e = r.RoundTrip(req)
+	assert.Error(t, e)
+}
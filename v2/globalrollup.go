@@ -78,3 +78,24 @@ func (s *rollupStatWrapper) Timing(stat string, value time.Duration, tags ...str
 		s.Sender.Timing(stat, value, rollup...)
 	}
 }
+
+// Distribution is emitted once with the original tags because distributions
+// are aggregated globally by the datadog backend.
+func (s *rollupStatWrapper) Distribution(stat string, value float64, tags ...string) {
+	sendDistribution(s.Sender, stat, value, tags...)
+}
+
+func (s *rollupStatWrapper) timingDistribution(stat string, value float64, tags ...string) {
+	sendTimingDistribution(s.Sender, stat, value, tags...)
+}
+
+func (s *rollupStatWrapper) sendValues(stat string, values []float64, kind string, tags []string) {
+	switch kind {
+	case "h", "ms":
+		for _, rollup := range s.computeTags(tags) {
+			sendSamples(s.Sender, stat, values, kind, rollup)
+		}
+	case "d", timingDistributionKind:
+		sendSamples(s.Sender, stat, values, kind, tags)
+	}
+}
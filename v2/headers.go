@@ -0,0 +1,150 @@
+package httpstats
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rs/xstats"
+)
+
+const (
+	headerNameTagName = "header_name"
+)
+
+// headerSizes holds the configuration of header size tracking.
+type headerSizes struct {
+	names              map[string]string
+	requestBytes       string
+	responseBytes      string
+	requestFields      string
+	responseFields     string
+	requestFieldBytes  string
+	responseFieldBytes string
+}
+
+func newHeaderSizes(prefix string, headerNames []string) *headerSizes {
+	var names = make(map[string]string, len(headerNames))
+	for _, name := range headerNames {
+		names[http.CanonicalHeaderKey(name)] = strings.ToLower(name)
+	}
+	return &headerSizes{
+		names:              names,
+		requestBytes:       prefix + "_request_header_bytes",
+		responseBytes:      prefix + "_response_header_bytes",
+		requestFields:      prefix + "_request_header_fields",
+		responseFields:     prefix + "_response_header_fields",
+		requestFieldBytes:  prefix + "_request_header_field_bytes",
+		responseFieldBytes: prefix + "_response_header_field_bytes",
+	}
+}
+
+// headerFieldSize returns the approximate wire size of a header field
+// including the separator and line ending.
+func headerFieldSize(name string, value string) int {
+	return len(name) + len(": ") + len(value) + len("\r\n")
+}
+
+// requestHeader returns the headers of a request including the Host header
+// which is removed from the header map by the http package.
+func requestHeader(r *http.Request, host string) http.Header {
+	if host == "" || r.Header.Get("Host") != "" {
+		return r.Header
+	}
+	var h = r.Header.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	h.Set("Host", host)
+	return h
+}
+
+// record emits the total size and number of fields of the headers along with
+// the size of each allowed header that is present.
+func (c *headerSizes) record(stat xstats.XStater, h http.Header, bytesName string, fieldsName string, fieldBytesName string, tags []string) {
+	var size = 0
+	var fields = 0
+	for name, values := range h {
+		var fieldSize = 0
+		for _, value := range values {
+			fieldSize = fieldSize + headerFieldSize(name, value)
+		}
+		size = size + fieldSize
+		fields = fields + len(values)
+		if tagValue, ok := c.names[name]; ok {
+			var fieldTags = make([]string, 0, len(tags)+1)
+			fieldTags = append(fieldTags, tags...)
+			fieldTags = append(fieldTags, fmt.Sprintf("%s:%s", headerNameTagName, tagValue))
+			stat.Histogram(fieldBytesName, float64(fieldSize), fieldTags...)
+		}
+	}
+	stat.Histogram(bytesName, float64(size), tags...)
+	stat.Histogram(fieldsName, float64(fields), tags...)
+}
+
+func (c *headerSizes) recordRequest(stat xstats.XStater, h http.Header, tags []string) {
+	c.record(stat, h, c.requestBytes, c.requestFields, c.requestFieldBytes, tags)
+}
+
+func (c *headerSizes) recordResponse(stat xstats.XStater, h http.Header, tags []string) {
+	c.record(stat, h, c.responseBytes, c.responseFields, c.responseFieldBytes, tags)
+}
+
+func (c *headerSizes) setNames(requestBytesName string, responseBytesName string, requestFieldsName string, responseFieldsName string, requestFieldBytesName string, responseFieldBytesName string) {
+	c.requestBytes = requestBytesName
+	c.responseBytes = responseBytesName
+	c.requestFields = requestFieldsName
+	c.responseFields = responseFieldsName
+	c.requestFieldBytes = requestFieldBytesName
+	c.responseFieldBytes = responseFieldBytesName
+}
+
+// MiddlewareOptionHeaderSizes enables histograms of the approximate wire size
+// of the request and response headers, service_request_header_bytes and
+// service_response_header_bytes, along with the number of header fields as
+// service_request_header_fields and service_response_header_fields. The size
+// of each header in the given list of names is also emitted as
+// service_request_header_field_bytes or service_response_header_field_bytes
+// tagged with header_name.
+func MiddlewareOptionHeaderSizes(headerNames ...string) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.headerSizes = newHeaderSizes("service", headerNames)
+		return m, nil
+	}
+}
+
+// MiddlewareOptionHeaderSizeNames sets the metric names used for header sizes.
+// This option must be given after MiddlewareOptionHeaderSizes.
+func MiddlewareOptionHeaderSizeNames(requestBytesName string, responseBytesName string, requestFieldsName string, responseFieldsName string, requestFieldBytesName string, responseFieldBytesName string) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		if m.headerSizes == nil {
+			return nil, fmt.Errorf("header sizes are not enabled")
+		}
+		m.headerSizes.setNames(requestBytesName, responseBytesName, requestFieldsName, responseFieldsName, requestFieldBytesName, responseFieldBytesName)
+		return m, nil
+	}
+}
+
+// TransportOptionHeaderSizes enables histograms of the approximate wire size
+// of the request and response headers, client_request_header_bytes and
+// client_response_header_bytes, along with the number of header fields as
+// client_request_header_fields and client_response_header_fields. The size of
+// each header in the given list of names is also emitted as
+// client_request_header_field_bytes or client_response_header_field_bytes
+// tagged with header_name. Response headers are only recorded when a response
+// is received.
+func TransportOptionHeaderSizes(headerNames ...string) TransportOption {
+	return func(m *Transport) *Transport {
+		m.headerSizes = newHeaderSizes("client", headerNames)
+		return m
+	}
+}
+
+// TransportOptionHeaderSizeNames sets the metric names used for header sizes.
+// The names have no effect unless TransportOptionHeaderSizes is also given.
+func TransportOptionHeaderSizeNames(requestBytesName string, responseBytesName string, requestFieldsName string, responseFieldsName string, requestFieldBytesName string, responseFieldBytesName string) TransportOption {
+	return func(m *Transport) *Transport {
+		m.headerSizeNames = []string{requestBytesName, responseBytesName, requestFieldsName, responseFieldsName, requestFieldBytesName, responseFieldBytesName}
+		return m
+	}
+}
@@ -0,0 +1,111 @@
+package httpstats
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/xstats"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func TestHeaderFieldSize(t *testing.T) {
+	assert.Equal(t, len("Cookie: a=b\r\n"), headerFieldSize("Cookie", "a=b"))
+}
+
+func TestRequestHeader(t *testing.T) {
+	var r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", "*/*")
+	var h = requestHeader(r, r.Host)
+	assert.Equal(t, "example.com", h.Get("Host"))
+	assert.Empty(t, r.Header.Get("Host"))
+	assert.Equal(t, r.Header, requestHeader(r, ""))
+}
+
+func TestMiddlewareOptionHeaderSizes(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionHeaderSizes("cookie", "Set-Cookie"),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "a=b")
+		w.Header().Add("Set-Cookie", "c=d")
+	})).(*Middleware)
+
+	var r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Cookie", "session=1234")
+	r.Header.Set("Accept", "*/*")
+	var tags = []interface{}{"server_method:GET", "server_status_code:200", "server_status:ok"}
+	var cookie = headerFieldSize("Cookie", "session=1234")
+	var setCookie = headerFieldSize("Set-Cookie", "a=b") + headerFieldSize("Set-Cookie", "c=d")
+	sender.EXPECT().Timing(m.requestTime, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesIn, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesOut, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesTotal, gomock.Any(), tags...)
+	sender.EXPECT().Histogram("service_request_header_field_bytes", float64(cookie), append(tags, "header_name:cookie")...)
+	sender.EXPECT().Histogram("service_request_header_bytes", float64(cookie+headerFieldSize("Accept", "*/*")+headerFieldSize("Host", "example.com")), tags...)
+	sender.EXPECT().Histogram("service_request_header_fields", float64(3), tags...)
+	sender.EXPECT().Histogram("service_response_header_field_bytes", float64(setCookie), append(tags, "header_name:set-cookie")...)
+	sender.EXPECT().Histogram("service_response_header_bytes", float64(setCookie), tags...)
+	sender.EXPECT().Histogram("service_response_header_fields", float64(2), tags...)
+	m.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestMiddlewareOptionHeaderSizeNames(t *testing.T) {
+	var result, _, e = NewMiddleware(
+		MiddlewareOptionHeaderSizes(),
+		MiddlewareOptionHeaderSizeNames("a", "b", "c", "d", "e", "f"),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(fixtureHandler{}).(*Middleware)
+	assert.Equal(t, "a", m.headerSizes.requestBytes)
+	assert.Equal(t, "f", m.headerSizes.responseFieldBytes)
+
+	_, _, e = NewMiddleware(MiddlewareOptionHeaderSizeNames("a", "b", "c", "d", "e", "f"))
+	assert.Error(t, e)
+}
+
+func TestTransportOptionHeaderSizes(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var stat = xstats.New(sender)
+	// The names apply regardless of the order of the options.
+	var r = NewTransport(
+		TransportOptionHeaderSizeNames("reqbytes", "respbytes", "reqfields", "respfields", "reqfieldbytes", "respfieldbytes"),
+		TransportOptionHeaderSizes("Authorization"),
+	)(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString(``)),
+		}, nil
+	}))
+
+	var req = httptest.NewRequest(http.MethodGet, "/", nil).WithContext(xstats.NewContext(context.Background(), stat))
+	req.Header.Set("Authorization", "Bearer token")
+	var authorization = headerFieldSize("Authorization", "Bearer token")
+	sender.EXPECT().Timing("client_request_time", gomock.Any(), "method:GET", "status_code:200", "status:ok")
+	sender.EXPECT().Histogram("client_request_bytes_received", gomock.Any())
+	sender.EXPECT().Histogram("reqfieldbytes", float64(authorization), "header_name:authorization")
+	sender.EXPECT().Histogram("reqbytes", float64(authorization+headerFieldSize("Host", "example.com")))
+	sender.EXPECT().Histogram("reqfields", float64(2))
+	sender.EXPECT().Histogram("respbytes", float64(headerFieldSize("Content-Type", "text/plain")))
+	sender.EXPECT().Histogram("respfields", float64(1))
+	var _, e = r.RoundTrip(req)
+	assert.NoError(t, e)
+}
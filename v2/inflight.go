@@ -0,0 +1,229 @@
+package httpstats
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xstats"
+)
+
+// inFlightCounter tracks the number of requests currently being processed
+// along with the highest number seen since the last flush.
+type inFlightCounter struct {
+	current int64
+	peak    int64
+}
+
+func (c *inFlightCounter) add() {
+	var current = atomic.AddInt64(&c.current, 1)
+	for {
+		var peak = atomic.LoadInt64(&c.peak)
+		if current <= peak || atomic.CompareAndSwapInt64(&c.peak, peak, current) {
+			return
+		}
+	}
+}
+
+func (c *inFlightCounter) done() {
+	atomic.AddInt64(&c.current, -1)
+}
+
+// flush returns the current and peak values and then resets the peak to the
+// current value so that the next interval starts from the present level.
+func (c *inFlightCounter) flush() (int64, int64) {
+	var current = atomic.LoadInt64(&c.current)
+	var peak = atomic.SwapInt64(&c.peak, current)
+	if current > peak {
+		peak = current
+	}
+	return current, peak
+}
+
+type inFlightKey struct {
+	method string
+	route  string
+}
+
+// inFlightTracker counts active requests overall and by method and route and
+// periodically emits the counts as gauges.
+type inFlightTracker struct {
+	interval     time.Duration
+	name         string
+	peakName     string
+	byRouteName  string
+	peakByRoute  string
+	routeEnabled bool
+	total        *inFlightCounter
+	lock         *sync.Mutex
+	counters     map[inFlightKey]*inFlightCounter
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+func newInFlightTracker(interval time.Duration) *inFlightTracker {
+	return &inFlightTracker{
+		interval:    interval,
+		name:        "service_requests_in_flight",
+		peakName:    "service_requests_in_flight_peak",
+		byRouteName: "service_requests_in_flight_by_route",
+		peakByRoute: "service_requests_in_flight_peak_by_route",
+		total:       &inFlightCounter{},
+		lock:        &sync.Mutex{},
+		counters:    make(map[inFlightKey]*inFlightCounter),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// inFlightRequest is an active request counted by an inFlightTracker.
+type inFlightRequest struct {
+	tracker *inFlightTracker
+	key     inFlightKey
+	counter *inFlightCounter
+}
+
+// counter returns the counter for the key, creating it if needed. It must be
+// called with the lock held.
+func (t *inFlightTracker) counter(key inFlightKey) *inFlightCounter {
+	var counter, ok = t.counters[key]
+	if !ok {
+		counter = &inFlightCounter{}
+		t.counters[key] = counter
+	}
+	return counter
+}
+
+// start marks the beginning of a request.
+func (t *inFlightTracker) start(key inFlightKey) *inFlightRequest {
+	t.total.add()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var counter = t.counter(key)
+	counter.add()
+	return &inFlightRequest{tracker: t, key: key, counter: counter}
+}
+
+// move counts the request under the given route instead of its current one.
+func (r *inFlightRequest) move(route string) {
+	if route == r.key.route {
+		return
+	}
+	r.tracker.lock.Lock()
+	defer r.tracker.lock.Unlock()
+	r.counter.done()
+	r.key.route = route
+	r.counter = r.tracker.counter(r.key)
+	r.counter.add()
+}
+
+// done marks the end of the request.
+func (r *inFlightRequest) done() {
+	r.tracker.lock.Lock()
+	r.counter.done()
+	r.tracker.lock.Unlock()
+	r.tracker.total.done()
+}
+
+func (t *inFlightTracker) keyTags(key inFlightKey) []string {
+	var tags = []string{fmt.Sprintf("server_method:%s", key.method)}
+	if t.routeEnabled && key.route != "" {
+		tags = append(tags, fmt.Sprintf("%s:%s", routeTagName, key.route))
+	}
+	return tags
+}
+
+// flush emits the current and peak gauges. Counters for method and route
+// pairs that have been idle for a full interval are removed after reporting
+// zero so that the number of tracked pairs does not grow without bound.
+func (t *inFlightTracker) flush(sender xstats.Sender) {
+	var current, peak = t.total.flush()
+	sender.Gauge(t.name, float64(current))
+	sender.Gauge(t.peakName, float64(peak))
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for key, counter := range t.counters {
+		current, peak = counter.flush()
+		var tags = t.keyTags(key)
+		sender.Gauge(t.byRouteName, float64(current), tags...)
+		sender.Gauge(t.peakByRoute, float64(peak), tags...)
+		if current == 0 && peak == 0 {
+			delete(t.counters, key)
+		}
+	}
+}
+
+func (t *inFlightTracker) run(sender xstats.Sender) {
+	defer close(t.done)
+	var ticker = time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.flush(sender)
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// MiddlewareOptionInFlight enables tracking of the requests currently being
+// processed. On each interval the number of active requests is emitted as the
+// service_requests_in_flight gauge along with the highest number of
+// concurrent requests seen during the interval as the
+// service_requests_in_flight_peak gauge. The same values are also emitted per
+// method, and per route if route tagging is enabled, as the
+// service_requests_in_flight_by_route and
+// service_requests_in_flight_peak_by_route gauges. Routers usually resolve the
+// route only once they have handled the request so a request is counted by
+// method alone, without the server_route tag, until its route is known or its
+// handler writes the response headers.
+func MiddlewareOptionInFlight(interval time.Duration) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		if interval <= 0 {
+			return nil, fmt.Errorf("in-flight interval must be positive: %s", interval)
+		}
+		m.inFlight = newInFlightTracker(interval)
+		return m, nil
+	}
+}
+
+// MiddlewareOptionInFlightNames sets the metric names used for the in-flight
+// gauges. The default values are service_requests_in_flight,
+// service_requests_in_flight_peak, service_requests_in_flight_by_route, and
+// service_requests_in_flight_peak_by_route. This option must be given after
+// MiddlewareOptionInFlight.
+func MiddlewareOptionInFlightNames(name string, peakName string, byRouteName string, peakByRouteName string) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		if m.inFlight == nil {
+			return nil, fmt.Errorf("in-flight tracking is not enabled")
+		}
+		m.inFlight.name = name
+		m.inFlight.peakName = peakName
+		m.inFlight.byRouteName = byRouteName
+		m.inFlight.peakByRoute = peakByRouteName
+		return m, nil
+	}
+}
+
+// trackInFlight records the start of a request if in-flight tracking is
+// enabled and returns the function to call once the request is complete.
+// When route tagging is enabled the request is moved to its route once the
+// response headers are written because routing has happened by then.
+func (m *Middleware) trackInFlight(r *http.Request, wrapper writerProxy) func() {
+	if m.inFlight == nil {
+		return func() {}
+	}
+	var key = inFlightKey{method: r.Method}
+	if len(m.routeExtractors) < 1 {
+		return m.inFlight.start(key).done
+	}
+	if route, ok := m.matchRoute(r); ok {
+		key.route = route
+	}
+	var request = m.inFlight.start(key)
+	wrapper.OnWriteHeader(func() { request.move(m.route(r)) })
+	return request.done
+}
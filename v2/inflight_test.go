@@ -0,0 +1,163 @@
+package httpstats
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func TestInFlightCounter(t *testing.T) {
+	var counter = &inFlightCounter{}
+	counter.add()
+	counter.add()
+	counter.done()
+	var current, peak = counter.flush()
+	assert.Equal(t, int64(1), current)
+	assert.Equal(t, int64(2), peak)
+	current, peak = counter.flush()
+	assert.Equal(t, int64(1), current)
+	assert.Equal(t, int64(1), peak)
+}
+
+func TestInFlightTrackerFlush(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockSender(ctrl)
+	var tracker = newInFlightTracker(time.Second)
+	tracker.routeEnabled = true
+	var key = inFlightKey{method: http.MethodGet, route: "/users/{id}"}
+	var first = tracker.start(key)
+	var second = tracker.start(key)
+	second.done()
+
+	sender.EXPECT().Gauge("service_requests_in_flight", float64(1))
+	sender.EXPECT().Gauge("service_requests_in_flight_peak", float64(2))
+	sender.EXPECT().Gauge("service_requests_in_flight_by_route", float64(1), "server_method:GET", "server_route:/users/{id}")
+	sender.EXPECT().Gauge("service_requests_in_flight_peak_by_route", float64(2), "server_method:GET", "server_route:/users/{id}")
+	tracker.flush(sender)
+
+	first.done()
+	sender.EXPECT().Gauge("service_requests_in_flight", float64(0))
+	sender.EXPECT().Gauge("service_requests_in_flight_peak", float64(1))
+	sender.EXPECT().Gauge("service_requests_in_flight_by_route", float64(0), "server_method:GET", "server_route:/users/{id}")
+	sender.EXPECT().Gauge("service_requests_in_flight_peak_by_route", float64(1), "server_method:GET", "server_route:/users/{id}")
+	tracker.flush(sender)
+
+	// Idle pairs report zero once and are then removed.
+	sender.EXPECT().Gauge("service_requests_in_flight", float64(0))
+	sender.EXPECT().Gauge("service_requests_in_flight_peak", float64(0))
+	sender.EXPECT().Gauge("service_requests_in_flight_by_route", float64(0), "server_method:GET", "server_route:/users/{id}")
+	sender.EXPECT().Gauge("service_requests_in_flight_peak_by_route", float64(0), "server_method:GET", "server_route:/users/{id}")
+	tracker.flush(sender)
+	assert.Empty(t, tracker.counters)
+}
+
+func TestMiddlewareOptionInFlight(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionInFlight(time.Hour),
+		MiddlewareOptionInFlightNames("inflight", "peak", "inflightroute", "peakroute"),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m *Middleware
+	var handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var current, peak = m.inFlight.total.flush()
+		assert.Equal(t, int64(1), current)
+		assert.Equal(t, int64(1), peak)
+		assert.Len(t, m.inFlight.counters, 1)
+		assert.Contains(t, m.inFlight.counters, inFlightKey{method: http.MethodPost})
+	})
+	m = result(handler).(*Middleware)
+	assert.Equal(t, "inflight", m.inFlight.name)
+	assert.Equal(t, "peakroute", m.inFlight.peakByRoute)
+	assert.False(t, m.inFlight.routeEnabled)
+
+	sender.EXPECT().Timing(m.requestTime, gomock.Any(), gomock.Any())
+	sender.EXPECT().Histogram(gomock.Any(), gomock.Any(), gomock.Any()).Times(3)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	var current, _ = m.inFlight.total.flush()
+	assert.Equal(t, int64(0), current)
+}
+
+// inFlightCurrent returns the number of requests counted under the key.
+func inFlightCurrent(m *Middleware, key inFlightKey) int64 {
+	m.inFlight.lock.Lock()
+	defer m.inFlight.lock.Unlock()
+	if counter, ok := m.inFlight.counters[key]; ok {
+		return atomic.LoadInt64(&counter.current)
+	}
+	return 0
+}
+
+// inFlightRouteHandler asserts that the request is counted by method alone
+// until it writes its headers and by its route afterwards.
+func inFlightRouteHandler(t *testing.T, m **Middleware) http.HandlerFunc {
+	var method = inFlightKey{method: http.MethodGet}
+	var route = inFlightKey{method: http.MethodGet, route: "/users/{id}"}
+	return func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, int64(1), inFlightCurrent(*m, method))
+		assert.Equal(t, int64(0), inFlightCurrent(*m, route))
+		w.WriteHeader(http.StatusOK)
+		assert.Equal(t, int64(0), inFlightCurrent(*m, method))
+		assert.Equal(t, int64(1), inFlightCurrent(*m, route))
+	}
+}
+
+func TestMiddlewareOptionInFlightRoute(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	sender.EXPECT().Timing(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	sender.EXPECT().Histogram(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionInFlight(time.Hour),
+		MiddlewareOptionRouteTag(RouteExtractorServeMux(nil), func(r *http.Request) (string, bool) {
+			var pattern = chi.RouteContext(r.Context()).RoutePattern()
+			return pattern, pattern != ""
+		}),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+
+	var m *Middleware
+	var sm = http.NewServeMux()
+	sm.Handle("GET /users/{id}", inFlightRouteHandler(t, &m))
+	m = result(sm).(*Middleware)
+	assert.True(t, m.inFlight.routeEnabled)
+	var w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var router = chi.NewRouter()
+	router.Use(func(next http.Handler) http.Handler {
+		m = result(next).(*Middleware)
+		return m
+	})
+	router.Get("/users/{id}", inFlightRouteHandler(t, &m))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestMiddlewareOptionInFlightInvalid(t *testing.T) {
+	var _, _, e = NewMiddleware(MiddlewareOptionInFlight(0))
+	assert.Error(t, e)
+	_, _, e = NewMiddleware(MiddlewareOptionInFlightNames("a", "b", "c", "d"))
+	assert.Error(t, e)
+}
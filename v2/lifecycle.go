@@ -0,0 +1,131 @@
+package httpstats
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/rs/xstats"
+)
+
+// lifecycle flushes and closes the senders and background work created by
+// NewMiddlewareCloser.
+type lifecycle struct {
+	lock      *sync.Mutex
+	closed    bool
+	inFlight  *inFlightTracker
+	sender    xstats.Sender
+	streaming *streaming
+	senders   []FlushCloser
+	conns     []io.Closer
+}
+
+// Flush writes any metrics buffered by the senders.
+func (l *lifecycle) Flush(ctx context.Context) error {
+	var errs []error
+	for _, sender := range l.senders {
+		errs = append(errs, sender.Flush(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops the background work of the middleware, reports the in-flight
+// gauges one last time, flushes the senders, and closes the connections they
+// write to.
+func (l *lifecycle) Close(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	var errs []error
+	if l.inFlight != nil {
+		var e = stopTracker(ctx, l.inFlight.stop, l.inFlight.done)
+		if e == nil {
+			l.inFlight.flush(l.sender)
+		}
+		errs = append(errs, e)
+	}
+	if l.streaming != nil {
+		l.streaming.close()
+	}
+	for _, sender := range l.senders {
+		errs = append(errs, sender.Close(ctx))
+	}
+	for _, conn := range l.conns {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// stopTracker stops a background loop and waits for it to exit.
+func stopTracker(ctx context.Context, stop chan struct{}, done chan struct{}) error {
+	close(stop)
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// MiddlewareOptionSynchronousFlush causes the statsd senders created by the
+// UDP sender options to write each metric before the call that records it
+// returns. This is intended for short lived processes, such as CLIs and batch
+// jobs, that may exit before a flush interval elapses.
+func MiddlewareOptionSynchronousFlush() MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.synchronous = true
+		return m, nil
+	}
+}
+
+// Flush emits the connection pool gauges, if enabled, and flushes any senders
+// that buffer metrics.
+func (t *Transport) Flush(ctx context.Context) error {
+	if t.pool != nil {
+		t.pool.flush()
+	}
+	return t.flushSenders(ctx, FlushCloser.Flush)
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped
+// http.RoundTripper if it supports doing so. This includes the copy of the
+// transport made for connection pool tracking.
+func (t *Transport) CloseIdleConnections() {
+	if closer, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// Close stops the background work of the Transport, such as connection pool
+// tracking, and closes any senders that buffer metrics. When connection pool
+// tracking is enabled the gauges are emitted one last time and the idle
+// connections of the copied transport are closed. Calling Close more than
+// once has no effect.
+func (t *Transport) Close(ctx context.Context) error {
+	var e error
+	t.closeOnce.Do(func() {
+		if t.pool != nil {
+			e = stopTracker(ctx, t.pool.stop, t.pool.done)
+			if e == nil {
+				t.pool.flush()
+			}
+			t.CloseIdleConnections()
+		}
+		e = errors.Join(e, t.flushSenders(ctx, FlushCloser.Close))
+	})
+	return e
+}
+
+func (t *Transport) flushSenders(ctx context.Context, action func(FlushCloser, context.Context) error) error {
+	var errs []error
+	for _, sender := range t.senders {
+		if flusher, ok := sender.(FlushCloser); ok {
+			errs = append(errs, action(flusher, ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
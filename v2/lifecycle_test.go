@@ -0,0 +1,93 @@
+package httpstats
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingConn records the packets written to it and whether it is closed.
+type recordingConn struct {
+	fixtureConn
+	*packetWriter
+	closed bool
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	return c.packetWriter.Write(b)
+}
+
+func (c *recordingConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func recordingDialer(conn *recordingConn) func(string, string) (net.Conn, error) {
+	return func(network string, address string) (net.Conn, error) {
+		return conn, nil
+	}
+}
+
+func TestNewMiddlewareCloser(t *testing.T) {
+	var conn = &recordingConn{packetWriter: newPacketWriter()}
+	var result, _, closer, e = NewMiddlewareCloser(
+		middlewareOptionUDPSenderDialer("localhost", 1024, time.Hour, "prefix.", recordingDialer(conn)),
+		MiddlewareOptionInFlight(time.Hour),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(fixtureHandler{}).(*Middleware)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Empty(t, conn.written())
+
+	assert.NoError(t, closer.Flush(context.Background()))
+	assert.Len(t, conn.written(), 1)
+	assert.True(t, strings.HasPrefix(conn.written()[0], "prefix.service_time:"))
+
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.NoError(t, closer.Close(context.Background()))
+	assert.Len(t, conn.written(), 2)
+	// The in-flight gauges are reported before the sender is closed.
+	assert.Contains(t, conn.written()[1], "prefix.service_requests_in_flight_peak:1.000000|g")
+	assert.True(t, conn.closed)
+	select {
+	case <-m.inFlight.done:
+	default:
+		t.Fatal("in flight tracking was not stopped")
+	}
+	assert.NoError(t, closer.Close(context.Background()))
+}
+
+func TestMiddlewareOptionSynchronousFlush(t *testing.T) {
+	var conn = &recordingConn{packetWriter: newPacketWriter()}
+	var result, _, closer, e = NewMiddlewareCloser(
+		middlewareOptionUDPSenderDialer("localhost", 1024, time.Hour, "", recordingDialer(conn)),
+		MiddlewareOptionSynchronousFlush(),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer closer.Close(context.Background())
+	var m = result(fixtureHandler{}).(*Middleware)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Len(t, conn.written(), 4)
+	assert.True(t, strings.HasPrefix(conn.written()[0], "service_time:"))
+}
+
+func TestTransportClose(t *testing.T) {
+	var m = NewTransport(TransportOptionConnectionPool(NewMockXStater(nil), time.Hour))(&http.Transport{}).(*Transport)
+	assert.NoError(t, m.Close(context.Background()))
+	select {
+	case <-m.pool.done:
+	default:
+		t.Fatal("connection pool tracking was not stopped")
+	}
+	assert.NoError(t, m.Close(context.Background()))
+}
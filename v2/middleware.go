@@ -5,14 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/rs/xstats"
-	"github.com/rs/xstats/dogstatsd"
 )
 
 const (
@@ -22,17 +21,39 @@ const (
 // Middleware is an http.Handler wrapper that instruments HTTP servers with the
 // standard SecDev metrics.
 type Middleware struct {
-	senders          []xstats.Sender
-	tags             []string
-	tagMap           map[string]string
-	next             http.Handler
-	requestTime      string
-	bytesIn          string
-	bytesOut         string
-	bytesTotal       string
-	requestTaggers   []func(*http.Request) (string, string)
-	finalSender      xstats.Sender
-	xstatsMiddleware func(http.Handler) http.Handler
+	senders            []xstats.Sender
+	tags               []string
+	tagMap             map[string]string
+	next               http.Handler
+	requestTime        string
+	timeToHeaders      string
+	timeToFirstByte    string
+	bytesIn            string
+	bytesOut           string
+	bytesTotal         string
+	requestTaggers     []func(*http.Request) (string, string)
+	routeExtractors    []RouteExtractor
+	cardinality        *cardinalityLimiter
+	cardinalityClamped string
+	inFlight           *inFlightTracker
+	panics             *panicRecovery
+	statusClassifier   StatusClassifier
+	slos               []sloDefinition
+	sloTotal           string
+	sloGood            string
+	protocolTags       bool
+	streaming          *streaming
+	headerSizes        *headerSizes
+	contentEncoding    *contentEncoding
+	distributions      *distributions
+	aggregation        *aggregation
+	statsd             []*StatsdSender
+	statsdStreams      []*StatsdStreamSender
+	flushers           []FlushCloser
+	conns              []io.Closer
+	synchronous        bool
+	finalSender        xstats.Sender
+	xstatsMiddleware   func(http.Handler) http.Handler
 }
 
 type recordingReader struct {
@@ -60,18 +81,67 @@ func (m *Middleware) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	var wrapper = wrapWriter(w, r.ProtoMajor)
 	var bodyWrapper = &recordingReader{r.Body, new(int32)}
 	r.Body = bodyWrapper
+	defer m.trackInFlight(r, wrapper)()
+	var stream *streamTracker
+	if m.streaming != nil {
+		stream = newStreamTracker(m.streaming, r, wrapper, bodyWrapper)
+		defer stream.finish()
+	}
+	var decoder *decodingCounter
+	if m.contentEncoding != nil && m.contentEncoding.decode {
+		decoder = newDecodingCounter(wrapper.Header())
+		wrapper.Tee(decoder)
+		defer decoder.close()
+	}
 	var start = time.Now()
+	if m.panics != nil {
+		defer m.recoverPanic(wrapper, r, bodyWrapper, stream, decoder, start)
+	}
 	m.next.ServeHTTP(wrapper, r)
+	m.emit(wrapper, r, bodyWrapper, stream, decoder, start, wrapper.Status(), m.statusClassifier(r, wrapper.Status(), r.Context().Err()))
+}
+
+// emit records the standard metrics for a completed request.
+func (m *Middleware) emit(wrapper writerProxy, r *http.Request, bodyWrapper *recordingReader, stream *streamTracker, decoder *decodingCounter, start time.Time, statusCode int, status string) {
 	var duration = time.Since(start)
-	tags = []string{
+	var tags = []string{
 		fmt.Sprintf("server_method:%s", r.Method),
-		fmt.Sprintf("server_status_code:%d", wrapper.Status()),
-		fmt.Sprintf("server_status:%s", responseStatus(r.Context(), wrapper.Status())),
+		fmt.Sprintf("server_status_code:%d", statusCode),
+		fmt.Sprintf("server_status:%s", status),
+	}
+	if len(m.routeExtractors) > 0 {
+		tags = append(tags, fmt.Sprintf("%s:%s", routeTagName, m.route(r)))
+	}
+	if m.protocolTags {
+		tags = append(tags, protocolTags(r)...)
+	}
+	if stream != nil {
+		tags = append(tags, fmt.Sprintf("%s:%s", responseTypeTagName, stream.responseType()))
+	}
+	m.distributions.timing(xstats.FromRequest(r), m.requestTime, duration, tags)
+	if headerTime := wrapper.HeaderTime(); !headerTime.IsZero() {
+		xstats.FromRequest(r).Timing(m.timeToHeaders, headerTime.Sub(start), tags...)
+	}
+	if firstWrite := wrapper.FirstWriteTime(); !firstWrite.IsZero() {
+		xstats.FromRequest(r).Timing(m.timeToFirstByte, firstWrite.Sub(start), tags...)
+	}
+	var byteTags = tags
+	if m.contentEncoding != nil {
+		byteTags = encodingTags(tags, serverRequestEncodingTagName, contentEncodingName(r.Header), serverResponseEncodingTagName, contentEncodingName(wrapper.Header()))
 	}
-	xstats.FromRequest(r).Timing(m.requestTime, duration, tags...)
-	xstats.FromRequest(r).Histogram(m.bytesIn, float64(bodyWrapper.BytesRead()), tags...)
-	xstats.FromRequest(r).Histogram(m.bytesOut, float64(wrapper.BytesWritten()), tags...)
-	xstats.FromRequest(r).Histogram(m.bytesTotal, float64(bodyWrapper.BytesRead()+wrapper.BytesWritten()), tags...)
+	m.distributions.histogram(xstats.FromRequest(r), m.bytesIn, float64(bodyWrapper.BytesRead()), byteTags)
+	m.distributions.histogram(xstats.FromRequest(r), m.bytesOut, float64(wrapper.BytesWritten()), byteTags)
+	m.distributions.histogram(xstats.FromRequest(r), m.bytesTotal, float64(bodyWrapper.BytesRead()+wrapper.BytesWritten()), byteTags)
+	if decoder != nil {
+		if decoded, encoded, ok := decoder.finish(wrapper.BytesWritten()); ok {
+			m.contentEncoding.record(xstats.FromRequest(r), wrapper.BytesWritten(), decoded, encoded, byteTags)
+		}
+	}
+	if m.headerSizes != nil {
+		m.headerSizes.recordRequest(xstats.FromRequest(r), requestHeader(r, r.Host), tags)
+		m.headerSizes.recordResponse(xstats.FromRequest(r), wrapper.Header(), tags)
+	}
+	m.recordSLOs(r, duration, status)
 }
 
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -79,19 +149,14 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func responseStatus(ctx context.Context, statusCode int) string {
-	if ctx.Err() != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			return "timeout"
-		}
-		return "cancelled"
-	}
-	if statusCode >= 200 && statusCode < 300 {
-		return "ok"
-	}
-	return errorName
+	return StatusClassifierDefault(nil, statusCode, ctx.Err())
 }
 
 func errorToStatusCode(err error) int {
+	var breakerErr *BreakerOpenError
+	if errors.As(err, &breakerErr) {
+		return http.StatusServiceUnavailable
+	}
 	if errors.Is(err, context.Canceled) {
 		return 499
 	}
@@ -113,21 +178,22 @@ func MiddlewareOptionTag(tagName string, tagValue string) MiddlewareOption {
 	}
 }
 
-// MiddlewareOptionUDPSender enables datadog style statsd emissions over UDP
+// MiddlewareOptionUDPSender enables datadog style statsd emissions over UDP.
+// The host may also be a unix:// or unixgram:// address of a unix datagram
+// socket. A maxPacketSize less than or equal to zero selects a default for
+// the network.
 func MiddlewareOptionUDPSender(host string, maxPacketSize int, flushInterval time.Duration, prefix string) MiddlewareOption {
 	return middlewareOptionUDPSenderDialer(host, maxPacketSize, flushInterval, prefix, net.Dial)
 }
 
 func middlewareOptionUDPSenderDialer(host string, maxPacketSize int, flushInterval time.Duration, prefix string, dialer func(network string, address string) (net.Conn, error)) MiddlewareOption {
 	return func(m *Middleware) (*Middleware, error) {
-		var statWriter, e = dialer("udp", host)
+		var statWriter, sender, e = dialStatsd(host, maxPacketSize, flushInterval, prefix, dialer)
 		if e != nil {
 			return nil, e
 		}
-		var sender = dogstatsd.NewMaxPacket(statWriter, flushInterval, maxPacketSize)
-		if len(prefix) > 0 {
-			sender = xstats.NewPrefix(sender, prefix)
-		}
+		m.statsd = append(m.statsd, sender)
+		m.conns = append(m.conns, statWriter)
 		m.senders = append(m.senders, sender)
 		return m, nil
 	}
@@ -136,20 +202,20 @@ func middlewareOptionUDPSenderDialer(host string, maxPacketSize int, flushInterv
 // MiddlewareOptionUDPGlobalRollupSender enables datadog style statsd emissions
 // over UDP but specifically for timers and percentiles which might need global
 // aggregation to prevent host outliers from skewing percentiles.
+// The host may also be a unix:// or unixgram:// address of a unix datagram
+// socket.
 func MiddlewareOptionUDPGlobalRollupSender(host string, maxPacketSize int, flushInterval time.Duration, prefix string, rollupTags []string) MiddlewareOption {
 	return middlewareOptionUDPGlobalRollupSenderDialer(host, maxPacketSize, flushInterval, prefix, rollupTags, net.Dial)
 }
 
 func middlewareOptionUDPGlobalRollupSenderDialer(host string, maxPacketSize int, flushInterval time.Duration, prefix string, rollupTags []string, dialer func(network string, address string) (net.Conn, error)) MiddlewareOption {
 	return func(m *Middleware) (*Middleware, error) {
-		var globalWriter, e = dialer("udp", host)
+		var globalWriter, globalSender, e = dialStatsd(host, maxPacketSize, flushInterval, prefix, dialer)
 		if e != nil {
 			return nil, e
 		}
-		var globalSender = dogstatsd.NewMaxPacket(globalWriter, flushInterval, maxPacketSize)
-		if len(prefix) > 0 {
-			globalSender = xstats.NewPrefix(globalSender, prefix)
-		}
+		m.statsd = append(m.statsd, globalSender)
+		m.conns = append(m.conns, globalWriter)
 		var rollupSender = &rollupStatWrapper{
 			Sender:  globalSender,
 			globals: rollupTags,
@@ -159,6 +225,21 @@ func middlewareOptionUDPGlobalRollupSenderDialer(host string, maxPacketSize int,
 	}
 }
 
+// dialStatsd connects to a statsd agent and creates a sender for it.
+func dialStatsd(host string, maxPacketSize int, flushInterval time.Duration, prefix string, dialer func(network string, address string) (net.Conn, error)) (net.Conn, *StatsdSender, error) {
+	var network, address = statsdNetwork(host)
+	var conn, e = dialer(network, address)
+	if e != nil {
+		return nil, nil, e
+	}
+	var sender = newStatsdSender(conn, statsdPacketSize(network, maxPacketSize), flushInterval)
+	sender.prefix = prefix
+	if network != "udp" {
+		sender.writeTimeout = unixWriteTimeout
+	}
+	return conn, sender, nil
+}
+
 // MiddlewareOptionBytesInName sets the metric name used to identity the number
 // of bytes read from an incoming HTTP request. The default value is
 // service_bytes_received
@@ -198,6 +279,26 @@ func MiddlewareOptionRequestTimeName(name string) MiddlewareOption {
 	}
 }
 
+// MiddlewareOptionTimeToHeadersName sets the metric name used to identify the
+// duration between receiving a request and writing the response headers. The
+// default value is service_time_to_headers.
+func MiddlewareOptionTimeToHeadersName(name string) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.timeToHeaders = name
+		return m, nil
+	}
+}
+
+// MiddlewareOptionTimeToFirstByteName sets the metric name used to identify
+// the duration between receiving a request and writing the first byte of the
+// response body. The default value is service_time_to_first_byte.
+func MiddlewareOptionTimeToFirstByteName(name string) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.timeToFirstByte = name
+		return m, nil
+	}
+}
+
 // MiddlewareOptionRequestTag is a function that is run on every incoming
 // request. The resulting key/value pair emitted is added to the stat sender
 // such that all stats emitted during the lifetime of the request will have the
@@ -213,43 +314,91 @@ func MiddlewareOptionRequestTag(tagger func(*http.Request) (string, string)) Mid
 // with a stat client that can be used to generate metrics outside the scope
 // of an HTTP request.
 func NewMiddleware(options ...MiddlewareOption) (func(http.Handler) http.Handler, xstats.XStater, error) {
+	var middleware, stat, _, e = NewMiddlewareCloser(options...)
+	return middleware, stat, e
+}
+
+// NewMiddlewareCloser is the same as NewMiddleware but also returns a
+// FlushCloser that drains the metrics buffered by the configured senders and
+// stops any background work. Close should be called before the process exits
+// so that the metrics recorded since the last flush interval are not lost.
+func NewMiddlewareCloser(options ...MiddlewareOption) (func(http.Handler) http.Handler, xstats.XStater, FlushCloser, error) {
 	xstats.DisablePooling = true
 	var e error
 	var m = &Middleware{
-		bytesIn:     "service_bytes_received",
-		bytesOut:    "service_bytes_returned",
-		bytesTotal:  "service_bytes_total",
-		requestTime: "service_time",
-		tagMap:      make(map[string]string),
+		bytesIn:            "service_bytes_received",
+		bytesOut:           "service_bytes_returned",
+		bytesTotal:         "service_bytes_total",
+		requestTime:        "service_time",
+		timeToHeaders:      "service_time_to_headers",
+		timeToFirstByte:    "service_time_to_first_byte",
+		cardinalityClamped: "service_tag_cardinality_clamped",
+		statusClassifier:   StatusClassifierDefault,
+		sloTotal:           "service_slo_total",
+		sloGood:            "service_slo_good",
+		tagMap:             make(map[string]string),
 	}
 
 	for _, option := range options {
 		m, e = option(m)
 		if e != nil {
-			return nil, nil, e
+			return nil, nil, nil, e
 		}
 	}
 
+	if m.distributions != nil {
+		m.distributions.resolve(m.requestTime, m.bytesIn, m.bytesOut, m.bytesTotal)
+	}
 	if len(m.senders) < 1 {
-		m.senders = append(m.senders, dogstatsd.New(ioutil.Discard, 10*time.Second))
+		// An empty MultiSender discards all metrics.
+		m.senders = append(m.senders, xstats.MultiSender{})
+	}
+	var senders = make([]FlushCloser, 0, len(m.statsd)+len(m.flushers))
+	for _, sender := range m.statsd {
+		sender.synchronous = m.synchronous
+		sender.start()
+		senders = append(senders, sender)
+	}
+	for _, sender := range m.statsdStreams {
+		sender.start()
 	}
+	senders = append(senders, m.flushers...)
 
-	var taggedSender = xstats.New(xstats.MultiSender(m.senders))
+	var sender xstats.Sender = xstats.MultiSender(m.senders)
+	if m.cardinality != nil {
+		sender = &cardinalitySender{
+			Sender:      sender,
+			limiter:     m.cardinality,
+			clampedName: m.cardinalityClamped,
+			tags:        m.tags,
+		}
+	}
+	if m.aggregation != nil && !m.synchronous {
+		var aggregator = NewAggregatingSender(sender, m.aggregation.interval, m.aggregation.options...)
+		sender = aggregator
+		// The aggregator is flushed first so that its metrics reach the
+		// senders before they are flushed.
+		senders = append([]FlushCloser{aggregator}, senders...)
+	}
+	var taggedSender = newDistributionStater(sender)
 	taggedSender.AddTags(m.tags...)
+	if m.inFlight != nil {
+		m.inFlight.routeEnabled = len(m.routeExtractors) > 0
+		go m.inFlight.run(taggedSender)
+	}
 
 	return func(next http.Handler) http.Handler {
-		return &Middleware{
-			bytesIn:          m.bytesIn,
-			bytesOut:         m.bytesOut,
-			bytesTotal:       m.bytesTotal,
-			requestTime:      m.requestTime,
-			tags:             m.tags,
-			tagMap:           m.tagMap,
-			next:             next,
-			requestTaggers:   m.requestTaggers,
-			finalSender:      taggedSender,
-			senders:          m.senders,
-			xstatsMiddleware: xstats.NewHandler(taggedSender, nil),
-		}
-	}, xstats.New(taggedSender), nil
+		var wrapped = *m
+		wrapped.next = next
+		wrapped.finalSender = taggedSender
+		wrapped.xstatsMiddleware = newStatHandler(taggedSender)
+		return &wrapped
+	}, newDistributionStater(taggedSender), &lifecycle{
+		lock:      &sync.Mutex{},
+		inFlight:  m.inFlight,
+		sender:    taggedSender,
+		streaming: m.streaming,
+		senders:   senders,
+		conns:     m.conns,
+	}, nil
 }
@@ -53,6 +53,43 @@ func TestMiddlewareOptionTag(t *testing.T) {
 	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
 }
 
+func TestMiddlewareTimeToFirstByte(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionTimeToHeadersName("headers"),
+		MiddlewareOptionTimeToFirstByteName("firstbyte"),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		time.Sleep(time.Millisecond)
+		_, _ = w.Write([]byte(`TEST`))
+	})).(*Middleware)
+	var headers, firstByte, total time.Duration
+	sender.EXPECT().Timing(m.requestTime, gomock.Any(), "server_method:GET", "server_status_code:202", "server_status:ok").Do(
+		func(_ string, d time.Duration, _ ...string) { total = d },
+	)
+	sender.EXPECT().Timing("headers", gomock.Any(), "server_method:GET", "server_status_code:202", "server_status:ok").Do(
+		func(_ string, d time.Duration, _ ...string) { headers = d },
+	)
+	sender.EXPECT().Timing("firstbyte", gomock.Any(), "server_method:GET", "server_status_code:202", "server_status:ok").Do(
+		func(_ string, d time.Duration, _ ...string) { firstByte = d },
+	)
+	sender.EXPECT().Histogram(m.bytesIn, gomock.Any(), "server_method:GET", "server_status_code:202", "server_status:ok")
+	sender.EXPECT().Histogram(m.bytesOut, float64(4), "server_method:GET", "server_status_code:202", "server_status:ok")
+	sender.EXPECT().Histogram(m.bytesTotal, gomock.Any(), "server_method:GET", "server_status_code:202", "server_status:ok")
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if headers <= 0 || firstByte < headers+time.Millisecond || total < firstByte {
+		t.Fatalf("unexpected timings: headers %s, first byte %s, total %s", headers, firstByte, total)
+	}
+}
+
 type fixtureConn struct{}
 
 func (*fixtureConn) Read(b []byte) (n int, err error) {
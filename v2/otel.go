@@ -0,0 +1,205 @@
+package httpstats
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xstats"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const otelScope = "github.com/asecurityteam/httpstats/v2"
+
+// otelAttributeNames maps the tag names used by this package to the
+// OpenTelemetry semantic convention attribute names. Tags not listed here are
+// recorded using the tag name as the attribute name.
+var otelAttributeNames = map[string]string{
+	"server_method":      "http.request.method",
+	"method":             "http.request.method",
+	"server_status_code": "http.response.status_code",
+	"status_code":        "http.response.status_code",
+	"server_route":       "http.route",
+	"server_address":     "server.address",
+}
+
+var (
+	// otelTimingBoundaries are the bucket boundaries, in seconds, recommended
+	// by the HTTP semantic conventions for request durations.
+	otelTimingBoundaries = []float64{0.005, 0.01, 0.025, 0.05, 0.075, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5, 7.5, 10}
+	// otelHistogramBoundaries are sized for the byte counts that make up most
+	// of the histograms emitted by this package.
+	otelHistogramBoundaries = defaultPrometheusHistogramBuckets
+)
+
+// otelSender is an xstats.Sender that records all stats using instruments
+// created from an OpenTelemetry Meter. Timers and histograms are recorded as
+// histograms, with timers recorded in seconds, counts as counters, and gauges
+// as gauges. Timers use the bucket boundaries of the HTTP semantic
+// conventions and histograms use boundaries sized for bytes.
+type otelSender struct {
+	meter      metric.Meter
+	lock       *sync.RWMutex
+	histograms map[string]metric.Float64Histogram
+	counters   map[string]metric.Float64Counter
+	gauges     map[string]metric.Float64Gauge
+}
+
+func newOTelSender(provider metric.MeterProvider) *otelSender {
+	return &otelSender{
+		meter:      provider.Meter(otelScope),
+		lock:       &sync.RWMutex{},
+		histograms: make(map[string]metric.Float64Histogram),
+		counters:   make(map[string]metric.Float64Counter),
+		gauges:     make(map[string]metric.Float64Gauge),
+	}
+}
+
+// otelInstrument returns the cached instrument for the stat or creates it. Errors
+// creating instruments are reported to the global OpenTelemetry error handler
+// and the instrument returned by the meter, which is always usable, is kept.
+func otelInstrument[T any](s *otelSender, cache map[string]T, stat string, create func() (T, error)) T {
+	s.lock.RLock()
+	var i, ok = cache[stat]
+	s.lock.RUnlock()
+	if ok {
+		return i
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if i, ok = cache[stat]; ok {
+		return i
+	}
+	var e error
+	i, e = create()
+	if e != nil {
+		otel.Handle(e)
+	}
+	cache[stat] = i
+	return i
+}
+
+func (s *otelSender) histogram(stat string, options ...metric.Float64HistogramOption) metric.Float64Histogram {
+	return otelInstrument(s, s.histograms, stat, func() (metric.Float64Histogram, error) {
+		return s.meter.Float64Histogram(stat, options...)
+	})
+}
+
+// Gauge implements xstats.Sender interface
+func (s *otelSender) Gauge(stat string, value float64, tags ...string) {
+	var gauge = otelInstrument(s, s.gauges, stat, func() (metric.Float64Gauge, error) {
+		return s.meter.Float64Gauge(stat)
+	})
+	gauge.Record(context.Background(), value, metric.WithAttributes(otelAttributes(tags)...))
+}
+
+// Count implements xstats.Sender interface
+func (s *otelSender) Count(stat string, count float64, tags ...string) {
+	var counter = otelInstrument(s, s.counters, stat, func() (metric.Float64Counter, error) {
+		return s.meter.Float64Counter(stat)
+	})
+	counter.Add(context.Background(), count, metric.WithAttributes(otelAttributes(tags)...))
+}
+
+// Histogram implements xstats.Sender interface
+func (s *otelSender) Histogram(stat string, value float64, tags ...string) {
+	s.histogram(stat, metric.WithExplicitBucketBoundaries(otelHistogramBoundaries...)).Record(context.Background(), value, metric.WithAttributes(otelAttributes(tags)...))
+}
+
+// Timing implements xstats.Sender interface
+func (s *otelSender) Timing(stat string, value time.Duration, tags ...string) {
+	s.histogram(stat, metric.WithUnit("s"), metric.WithExplicitBucketBoundaries(otelTimingBoundaries...)).Record(context.Background(), value.Seconds(), metric.WithAttributes(otelAttributes(tags)...))
+}
+
+// otelAttributes converts statsd tags into OpenTelemetry attributes. Status
+// codes are recorded as integers to match the semantic conventions.
+func otelAttributes(tags []string) []attribute.KeyValue {
+	var attributes = make([]attribute.KeyValue, 0, len(tags))
+	for _, tag := range tags {
+		var key, value, found = strings.Cut(tag, ":")
+		if !found {
+			attributes = append(attributes, attribute.Bool(key, true))
+			continue
+		}
+		if name, ok := otelAttributeNames[key]; ok {
+			key = name
+		}
+		if key == "http.response.status_code" {
+			if code, e := strconv.Atoi(value); e == nil {
+				attributes = append(attributes, attribute.Int(key, code))
+				continue
+			}
+		}
+		attributes = append(attributes, attribute.String(key, value))
+	}
+	return attributes
+}
+
+// teeStater is an xstats.XStater that forwards all stats to the wrapped
+// XStater and to an additional sender. The additional sender receives the
+// tags of the wrapped XStater along with the extra tags.
+type teeStater struct {
+	xstats.XStater
+	sender xstats.Sender
+	tags   []string
+}
+
+func (s *teeStater) allTags(tags []string) []string {
+	var output = make([]string, 0, len(tags)+len(s.tags)+len(s.XStater.GetTags()))
+	output = append(output, tags...)
+	output = append(output, s.XStater.GetTags()...)
+	return append(output, s.tags...)
+}
+
+func (s *teeStater) Gauge(stat string, value float64, tags ...string) {
+	s.XStater.Gauge(stat, value, tags...)
+	s.sender.Gauge(stat, value, s.allTags(tags)...)
+}
+func (s *teeStater) Count(stat string, value float64, tags ...string) {
+	s.XStater.Count(stat, value, tags...)
+	s.sender.Count(stat, value, s.allTags(tags)...)
+}
+func (s *teeStater) Histogram(stat string, value float64, tags ...string) {
+	s.XStater.Histogram(stat, value, tags...)
+	s.sender.Histogram(stat, value, s.allTags(tags)...)
+}
+func (s *teeStater) Timing(stat string, value time.Duration, tags ...string) {
+	s.XStater.Timing(stat, value, tags...)
+	s.sender.Timing(stat, value, s.allTags(tags)...)
+}
+func (s *teeStater) Distribution(stat string, value float64, tags ...string) {
+	sendDistribution(s.XStater, stat, value, tags...)
+	sendDistribution(s.sender, stat, value, s.allTags(tags)...)
+}
+func (s *teeStater) timingDistribution(stat string, value float64, tags ...string) {
+	sendTimingDistribution(s.XStater, stat, value, tags...)
+	sendTimingDistribution(s.sender, stat, value, s.allTags(tags)...)
+}
+
+// MiddlewareOptionOTelMeterProvider enables emissions through instruments
+// created by the given OpenTelemetry MeterProvider in addition to any other
+// senders. Metric names are unchanged and tags are recorded as attributes
+// using the semantic convention names where one exists, such as
+// http.request.method and http.response.status_code.
+func MiddlewareOptionOTelMeterProvider(provider metric.MeterProvider) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.senders = append(m.senders, newOTelSender(provider))
+		return m, nil
+	}
+}
+
+// TransportOptionOTelMeterProvider enables emissions through instruments
+// created by the given OpenTelemetry MeterProvider in addition to the stat
+// client of the request. Metric names are unchanged and tags are recorded as
+// attributes using the semantic convention names where one exists. The host
+// of the outgoing request is recorded as the server.address attribute.
+func TransportOptionOTelMeterProvider(provider metric.MeterProvider) TransportOption {
+	return func(m *Transport) *Transport {
+		m.senders = append(m.senders, newOTelSender(provider))
+		return m
+	}
+}
@@ -0,0 +1,124 @@
+package httpstats
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/xstats"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/mock/gomock"
+)
+
+func collectOTel(t *testing.T, reader sdkmetric.Reader) map[string]metricdata.Aggregation {
+	var rm metricdata.ResourceMetrics
+	if e := reader.Collect(context.Background(), &rm); e != nil {
+		t.Fatal(e.Error())
+	}
+	var output = make(map[string]metricdata.Aggregation)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			output[m.Name] = m.Data
+		}
+	}
+	return output
+}
+
+func TestOTelSender(t *testing.T) {
+	var reader = sdkmetric.NewManualReader()
+	var sender = newOTelSender(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	sender.Count("count", 2, "flag")
+	sender.Gauge("gauge", 3, "status_code:404")
+	sender.Histogram("histogram", 4, "method:GET")
+
+	var metrics = collectOTel(t, reader)
+	var count = metrics["count"].(metricdata.Sum[float64])
+	assert.Equal(t, 2.0, count.DataPoints[0].Value)
+	assert.Equal(t, attribute.NewSet(attribute.Bool("flag", true)), count.DataPoints[0].Attributes)
+	var gauge = metrics["gauge"].(metricdata.Gauge[float64])
+	assert.Equal(t, 3.0, gauge.DataPoints[0].Value)
+	assert.Equal(t, attribute.NewSet(attribute.Int("http.response.status_code", 404)), gauge.DataPoints[0].Attributes)
+	var histogram = metrics["histogram"].(metricdata.Histogram[float64])
+	assert.Equal(t, 4.0, histogram.DataPoints[0].Sum)
+	assert.Equal(t, attribute.NewSet(attribute.String("http.request.method", "GET")), histogram.DataPoints[0].Attributes)
+	assert.Equal(t, otelHistogramBoundaries, histogram.DataPoints[0].Bounds)
+}
+
+func TestOTelSenderTimingBoundaries(t *testing.T) {
+	var reader = sdkmetric.NewManualReader()
+	var sender = newOTelSender(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	sender.Timing("timing", 20*time.Millisecond)
+
+	var timing = collectOTel(t, reader)["timing"].(metricdata.Histogram[float64])
+	assert.Equal(t, otelTimingBoundaries, timing.DataPoints[0].Bounds)
+	// 20ms falls in the (0.01, 0.025] bucket.
+	assert.Equal(t, uint64(1), timing.DataPoints[0].BucketCounts[2])
+}
+
+func TestMiddlewareOptionOTelMeterProvider(t *testing.T) {
+	var reader = sdkmetric.NewManualReader()
+	var result, _, e = NewMiddleware(
+		MiddlewareOptionOTelMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))),
+		MiddlewareOptionTag(testName, testName),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	result(fixtureHandler{}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var metrics = collectOTel(t, reader)
+	var expected = attribute.NewSet(
+		attribute.String("http.request.method", "GET"),
+		attribute.Int("http.response.status_code", 200),
+		attribute.String("server_status", "ok"),
+		attribute.String(testName, testName),
+	)
+	var duration = metrics["service_time"].(metricdata.Histogram[float64])
+	assert.Equal(t, uint64(1), duration.DataPoints[0].Count)
+	assert.Equal(t, expected, duration.DataPoints[0].Attributes)
+	for _, name := range []string{"service_bytes_received", "service_bytes_returned", "service_bytes_total"} {
+		var histogram = metrics[name].(metricdata.Histogram[float64])
+		assert.Equal(t, expected, histogram.DataPoints[0].Attributes, name)
+	}
+}
+
+func TestTransportOptionOTelMeterProvider(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var reader = sdkmetric.NewManualReader()
+	var sender = NewMockXStater(ctrl)
+	var stat = xstats.New(sender)
+	stat.AddTags("context:tag")
+	var result = NewTransport(
+		TransportOptionTag(testName, testName),
+		TransportOptionOTelMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))),
+	)
+	var r = result(&instanceStoreTransport{})
+
+	sender.EXPECT().Timing("client_request_time", gomock.Any(), "test:test", "method:GET", "status_code:200", "status:ok", "context:tag")
+	sender.EXPECT().Histogram("client_request_bytes_received", gomock.Any(), "test:test", "context:tag")
+	sender.EXPECT().Histogram("client_request_bytes_sent", gomock.Any(), "test:test", "context:tag")
+	sender.EXPECT().Histogram("client_request_bytes_total", gomock.Any(), "test:test", "context:tag")
+	var req = httptest.NewRequest(http.MethodGet, "http://example.com:8080/", nil).WithContext(xstats.NewContext(context.Background(), stat))
+	var resp, _ = r.RoundTrip(req)
+	resp.Body.Close()
+
+	var metrics = collectOTel(t, reader)
+	var duration = metrics["client_request_time"].(metricdata.Histogram[float64])
+	assert.Equal(t, attribute.NewSet(
+		attribute.String(testName, testName),
+		attribute.String("http.request.method", "GET"),
+		attribute.Int("http.response.status_code", 200),
+		attribute.String("status", "ok"),
+		attribute.String("context", "tag"),
+		attribute.String("server.address", "example.com"),
+	), duration.DataPoints[0].Attributes)
+	var total = metrics["client_request_bytes_total"].(metricdata.Histogram[float64])
+	assert.Equal(t, uint64(1), total.DataPoints[0].Count)
+}
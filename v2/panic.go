@@ -0,0 +1,79 @@
+package httpstats
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/rs/xstats"
+)
+
+const panicStatus = "panic"
+
+// PanicHandler functions are called by the Middleware with the request, the
+// value recovered from a panic in the wrapped handler, and the stack trace of
+// the panic.
+type PanicHandler func(r *http.Request, value interface{}, stack []byte)
+
+type panicRecovery struct {
+	name    string
+	repanic bool
+	handler PanicHandler
+}
+
+// recoverPanic is deferred around the wrapped handler so that requests which
+// panic are still recorded. It must be called directly by defer in order for
+// recover to stop the panic.
+func (m *Middleware) recoverPanic(wrapper writerProxy, r *http.Request, bodyWrapper *recordingReader, stream *streamTracker, decoder *decodingCounter, start time.Time) {
+	var value = recover()
+	if value == nil {
+		return
+	}
+	var stack = debug.Stack()
+	xstats.FromRequest(r).Count(m.panics.name, 1, fmt.Sprintf("panic_type:%T", value))
+	m.emit(wrapper, r, bodyWrapper, stream, decoder, start, http.StatusInternalServerError, panicStatus)
+	if m.panics.handler != nil {
+		m.panics.handler(r, value, stack)
+	}
+	// The http.ErrAbortHandler sentinel is always raised again because it is
+	// how handlers ask the server to abort the response.
+	if m.panics.repanic || value == http.ErrAbortHandler {
+		panic(value)
+	}
+	if wrapper.HeaderTime().IsZero() {
+		wrapper.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// MiddlewareOptionPanicRecovery enables the recording of requests for which
+// the wrapped handler panics. Such requests are recorded with the standard
+// metrics using a server_status_code of 500 and a server_status of panic. A
+// service_panics counter, tagged with the panic_type, is also emitted. If
+// repanic is true then the panic is raised again once it has been recorded.
+// Otherwise, the panic is recovered and a 500 response is written if the
+// handler had not yet written the response headers. The handler, if not nil,
+// is called with the panic value and stack trace.
+func MiddlewareOptionPanicRecovery(repanic bool, handler PanicHandler) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.panics = &panicRecovery{
+			name:    "service_panics",
+			repanic: repanic,
+			handler: handler,
+		}
+		return m, nil
+	}
+}
+
+// MiddlewareOptionPanicsName sets the metric name used to count panics in the
+// wrapped handler. The default value is service_panics. This option must be
+// given after MiddlewareOptionPanicRecovery.
+func MiddlewareOptionPanicsName(name string) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		if m.panics == nil {
+			return nil, fmt.Errorf("panic recovery is not enabled")
+		}
+		m.panics.name = name
+		return m, nil
+	}
+}
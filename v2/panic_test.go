@@ -0,0 +1,97 @@
+package httpstats
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func panicHandler(value interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(value)
+	})
+}
+
+func expectPanicStats(sender *MockXStater, m *Middleware, panicType string) {
+	var tags = []interface{}{"server_method:GET", "server_status_code:500", "server_status:panic"}
+	sender.EXPECT().Count("service_panics", float64(1), "panic_type:"+panicType)
+	sender.EXPECT().Timing(m.requestTime, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesIn, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesOut, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesTotal, gomock.Any(), tags...)
+}
+
+func TestMiddlewareOptionPanicRecovery(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var recovered interface{}
+	var stack []byte
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionPanicRecovery(false, func(r *http.Request, value interface{}, s []byte) {
+			recovered = value
+			stack = s
+		}),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(panicHandler("boom")).(*Middleware)
+	expectPanicStats(sender, m, "string")
+	var w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "boom", recovered)
+	assert.Contains(t, string(stack), "panicHandler")
+}
+
+func TestMiddlewareOptionPanicRecoveryRepanic(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionPanicRecovery(true, nil),
+		MiddlewareOptionPanicsName("panics"),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var value = errors.New("boom")
+	var m = result(panicHandler(value)).(*Middleware)
+	var tags = []interface{}{"server_method:GET", "server_status_code:500", "server_status:panic"}
+	sender.EXPECT().Count("panics", float64(1), "panic_type:*errors.errorString")
+	sender.EXPECT().Timing(m.requestTime, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(gomock.Any(), gomock.Any(), tags...).Times(3)
+	assert.PanicsWithValue(t, value, func() {
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+}
+
+func TestMiddlewareOptionPanicRecoveryAbortHandler(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(middlewareOptionSender(sender), MiddlewareOptionPanicRecovery(false, nil))
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(panicHandler(http.ErrAbortHandler)).(*Middleware)
+	expectPanicStats(sender, m, "*errors.errorString")
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+}
+
+func TestMiddlewareOptionPanicsNameInvalid(t *testing.T) {
+	var _, _, e = NewMiddleware(MiddlewareOptionPanicsName("panics"))
+	assert.Error(t, e)
+}
@@ -0,0 +1,307 @@
+package httpstats
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rs/xstats"
+)
+
+type poolHost struct {
+	active  int64
+	idle    int64
+	dialing int64
+	open    int64
+}
+
+func (h *poolHost) empty() bool {
+	return h.active == 0 && h.idle == 0 && h.dialing == 0 && h.open == 0
+}
+
+// pooledConn is a connection created by a dialer wrapped by the poolTracker.
+// It records when the connection is closed so that open and idle connections
+// can be counted.
+type pooledConn struct {
+	net.Conn
+	tracker *poolTracker
+	host    string
+	idle    bool
+	once    *sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	c.once.Do(func() {
+		c.tracker.closed(c)
+	})
+	return c.Conn.Close()
+}
+
+// unwrapPooledConn returns the pooledConn that underlies a connection handed
+// out by the http.Transport, such as a *tls.Conn, if there is one.
+func unwrapPooledConn(conn net.Conn) *pooledConn {
+	for conn != nil {
+		if pooled, ok := conn.(*pooledConn); ok {
+			return pooled
+		}
+		var wrapper, ok = conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapper.NetConn()
+	}
+	return nil
+}
+
+// poolTargetContextKey holds the target host:port of a request in the
+// request context. The http.Transport passes the values of the request
+// context to its dialers which allows dialed connections to be counted
+// against the target rather than against a proxy.
+type poolTargetContextKey struct{}
+
+// poolTarget returns the host:port that a request is sent to, using the
+// default port of the scheme if the URL does not include one.
+func poolTarget(u *url.URL) string {
+	var port = u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// poolTracker counts the connections of a client per host and periodically
+// emits the counts as gauges.
+type poolTracker struct {
+	stat        xstats.XStater
+	interval    time.Duration
+	activeName  string
+	idleName    string
+	dialingName string
+	openName    string
+	lock        *sync.Mutex
+	hosts       map[string]*poolHost
+	requests    map[net.Conn]int
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+func newPoolTracker(stat xstats.XStater, interval time.Duration) *poolTracker {
+	return &poolTracker{
+		stat:        stat,
+		interval:    interval,
+		activeName:  "client_connections_active",
+		idleName:    "client_connections_idle",
+		dialingName: "client_connections_dialing",
+		openName:    "client_connections_open",
+		lock:        &sync.Mutex{},
+		hosts:       make(map[string]*poolHost),
+		requests:    make(map[net.Conn]int),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// host must be called with the lock held.
+func (p *poolTracker) host(host string) *poolHost {
+	var h, ok = p.hosts[host]
+	if !ok {
+		h = &poolHost{}
+		p.hosts[host] = h
+	}
+	return h
+}
+
+func (p *poolTracker) dialing(host string, delta int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.host(host).dialing += delta
+}
+
+// acquire records that a request obtained a connection to the host. A
+// connection is active while it is held by at least one request so that an
+// HTTP/2 connection carrying several requests is only counted once.
+func (p *poolTracker) acquire(host string, conn net.Conn) *pooledConn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.requests[conn]++
+	if p.requests[conn] == 1 {
+		p.host(host).active++
+	}
+	var pooled = unwrapPooledConn(conn)
+	if pooled != nil && pooled.idle {
+		pooled.idle = false
+		p.host(pooled.host).idle--
+	}
+	return pooled
+}
+
+// release records that a request no longer holds a connection to the host.
+func (p *poolTracker) release(host string, conn net.Conn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.requests[conn]--
+	if p.requests[conn] > 0 {
+		return
+	}
+	delete(p.requests, conn)
+	p.host(host).active--
+}
+
+func (p *poolTracker) putIdle(conn *pooledConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !conn.idle {
+		conn.idle = true
+		p.host(conn.host).idle++
+	}
+}
+
+func (p *poolTracker) closed(conn *pooledConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var h = p.host(conn.host)
+	h.open--
+	if conn.idle {
+		conn.idle = false
+		h.idle--
+	}
+}
+
+// wrapDial returns a dial function that counts the connections it creates.
+// Connections are counted against the target of the request that caused the
+// dial, which differs from the dialed address when a proxy is used.
+func (p *poolTracker) wrapDial(dial func(ctx context.Context, network string, addr string) (net.Conn, error)) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		var conn, e = dial(ctx, network, addr)
+		if e != nil {
+			return conn, e
+		}
+		var host, ok = ctx.Value(poolTargetContextKey{}).(string)
+		if !ok {
+			host = addr
+		}
+		p.lock.Lock()
+		p.host(host).open++
+		p.lock.Unlock()
+		return &pooledConn{Conn: conn, tracker: p, host: host, once: &sync.Once{}}, nil
+	}
+}
+
+// legacyDial adapts one of the deprecated dial functions of an
+// http.Transport, which do not take a context.
+func legacyDial(dial func(network string, addr string) (net.Conn, error)) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return func(_ context.Context, network string, addr string) (net.Conn, error) {
+		return dial(network, addr)
+	}
+}
+
+// wrapTransport returns a copy of the transport that uses counting dialers.
+// The deprecated Dial and DialTLS functions are used if they are set and
+// their context aware replacements are not. Any other kind of
+// http.RoundTripper is returned unchanged in which case only active and
+// dialing connections are counted.
+func (p *poolTracker) wrapTransport(next http.RoundTripper) http.RoundTripper {
+	var transport, ok = next.(*http.Transport)
+	if !ok {
+		return next
+	}
+	transport = transport.Clone()
+	var dial = transport.DialContext
+	if dial == nil && transport.Dial != nil {
+		dial = legacyDial(transport.Dial)
+	}
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	transport.DialContext = p.wrapDial(dial)
+	var dialTLS = transport.DialTLSContext
+	if dialTLS == nil && transport.DialTLS != nil {
+		dialTLS = legacyDial(transport.DialTLS)
+	}
+	if dialTLS != nil {
+		transport.DialTLSContext = p.wrapDial(dialTLS)
+	}
+	return transport
+}
+
+// flush emits the gauges for each host. Hosts without any connections are
+// removed after reporting zero.
+func (p *poolTracker) flush() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for host, h := range p.hosts {
+		var tag = fmt.Sprintf("host:%s", host)
+		p.stat.Gauge(p.activeName, float64(h.active), tag)
+		p.stat.Gauge(p.idleName, float64(h.idle), tag)
+		p.stat.Gauge(p.dialingName, float64(h.dialing), tag)
+		p.stat.Gauge(p.openName, float64(h.open), tag)
+		if h.empty() {
+			delete(p.hosts, host)
+		}
+	}
+}
+
+func (p *poolTracker) run() {
+	defer close(p.done)
+	var ticker = time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.flush()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// TransportOptionConnectionPool enables tracking of the connections used by
+// the client. On each interval the client_connections_active,
+// client_connections_idle, client_connections_dialing, and
+// client_connections_open gauges are emitted to the given stat client for
+// each target host:port, including requests sent through a proxy. Active
+// connections are those held by at least one request so an HTTP/2 connection
+// is counted once however many requests share it. Open and idle
+// connections can only be counted if the wrapped http.RoundTripper is an
+// *http.Transport, in which case a copy of it is used that wraps its dialers.
+// Changes made to the original transport after it is wrapped do not apply to
+// the copy, and its CloseIdleConnections method does not close the idle
+// connections of the copy. Use the CloseIdleConnections method of the
+// Transport, or of the http.Client using it, instead. The gauges are emitted
+// until the Transport is closed with Close. Intervals less than or equal to
+// zero are ignored.
+func TransportOptionConnectionPool(stat xstats.XStater, interval time.Duration) TransportOption {
+	return func(m *Transport) *Transport {
+		if interval > 0 {
+			m.pool = newPoolTracker(stat, interval)
+		}
+		return m
+	}
+}
+
+// TransportOptionConnectionPoolNames sets the metric names used for the
+// connection pool gauges. The default values are client_connections_active,
+// client_connections_idle, client_connections_dialing, and
+// client_connections_open. The names have no effect unless
+// TransportOptionConnectionPool is also given.
+func TransportOptionConnectionPoolNames(activeName string, idleName string, dialingName string, openName string) TransportOption {
+	return func(m *Transport) *Transport {
+		m.poolNames = []string{activeName, idleName, dialingName, openName}
+		return m
+	}
+}
+
+// setNames sets the metric names used for the gauges.
+func (p *poolTracker) setNames(names []string) {
+	p.activeName = names[0]
+	p.idleName = names[1]
+	p.dialingName = names[2]
+	p.openName = names[3]
+}
@@ -0,0 +1,219 @@
+package httpstats
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func expectPoolGauges(sender *MockXStater, host string, active float64, idle float64, dialing float64, open float64) {
+	var tag = "host:" + host
+	gomock.InOrder(
+		sender.EXPECT().Gauge("active", active, tag),
+		sender.EXPECT().Gauge("idle", idle, tag),
+		sender.EXPECT().Gauge("dialing", dialing, tag),
+		sender.EXPECT().Gauge("open", open, tag),
+	)
+}
+
+func TestUnwrapPooledConn(t *testing.T) {
+	var first, second = net.Pipe()
+	defer first.Close()
+	defer second.Close()
+	var pooled = &pooledConn{Conn: first, once: &sync.Once{}}
+	assert.Equal(t, pooled, unwrapPooledConn(pooled))
+	assert.Nil(t, unwrapPooledConn(first))
+	assert.Nil(t, unwrapPooledConn(nil))
+}
+
+func TestTransportOptionConnectionPool(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("response"))
+	}))
+	defer server.Close()
+	var host = server.Listener.Addr().String()
+
+	var sender = NewMockXStater(ctrl)
+	var base = &http.Transport{}
+	var m = NewTransport(
+		TransportOptionConnectionPool(sender, time.Hour),
+		TransportOptionConnectionPoolNames("active", "idle", "dialing", "open"),
+	)(base).(*Transport)
+	defer m.Close(context.Background())
+	var wrapped, ok = m.next.(*http.Transport)
+	assert.True(t, ok)
+	assert.NotEqual(t, base, wrapped)
+
+	var target, _ = url.Parse(server.URL)
+	var resp, e = m.RoundTrip(&http.Request{Method: http.MethodGet, URL: target, Header: http.Header{}})
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	expectPoolGauges(sender, host, 1, 0, 0, 1)
+	m.pool.flush()
+
+	_, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	expectPoolGauges(sender, host, 0, 1, 0, 1)
+	m.pool.flush()
+
+	resp, e = m.RoundTrip(&http.Request{Method: http.MethodGet, URL: target, Header: http.Header{}})
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	expectPoolGauges(sender, host, 1, 0, 0, 1)
+	m.pool.flush()
+	_, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	m.CloseIdleConnections()
+	expectPoolGauges(sender, host, 0, 0, 0, 0)
+	m.pool.flush()
+	assert.Empty(t, m.pool.hosts)
+}
+
+func TestPoolTrackerSharedConnection(t *testing.T) {
+	var tracker = newPoolTracker(nil, time.Hour)
+	var first, second = net.Pipe()
+	defer first.Close()
+	defer second.Close()
+
+	// Requests sharing a connection, as with HTTP/2, count it once.
+	tracker.acquire("example.com:443", first)
+	tracker.acquire("example.com:443", first)
+	assert.Equal(t, int64(1), tracker.hosts["example.com:443"].active)
+	tracker.release("example.com:443", first)
+	assert.Equal(t, int64(1), tracker.hosts["example.com:443"].active)
+	tracker.release("example.com:443", first)
+	assert.Equal(t, int64(0), tracker.hosts["example.com:443"].active)
+	assert.Empty(t, tracker.requests)
+}
+
+func TestPoolTarget(t *testing.T) {
+	var cases = map[string]string{
+		"http://example.com/":       "example.com:80",
+		"https://example.com/":      "example.com:443",
+		"https://example.com:8443/": "example.com:8443",
+		"http://[::1]/":             "[::1]:80",
+	}
+	for target, expected := range cases {
+		var u, _ = url.Parse(target)
+		assert.Equal(t, expected, poolTarget(u), target)
+	}
+}
+
+func TestTransportOptionConnectionPoolProxy(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var proxy = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("response"))
+	}))
+	defer proxy.Close()
+	var proxyURL, _ = url.Parse(proxy.URL)
+
+	var sender = NewMockXStater(ctrl)
+	// The names apply regardless of the order of the options.
+	var m = NewTransport(
+		TransportOptionConnectionPoolNames("active", "idle", "dialing", "open"),
+		TransportOptionConnectionPool(sender, time.Hour),
+	)(&http.Transport{Proxy: http.ProxyURL(proxyURL)}).(*Transport)
+
+	var target, _ = url.Parse("http://example.com/")
+	var resp, e = m.RoundTrip(&http.Request{Method: http.MethodGet, URL: target, Header: http.Header{}})
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	// The connection to the proxy is counted against the target.
+	expectPoolGauges(sender, "example.com:80", 1, 0, 0, 1)
+	m.pool.flush()
+	_, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	expectPoolGauges(sender, "example.com:80", 0, 1, 0, 1)
+	m.pool.flush()
+	expectPoolGauges(sender, "example.com:80", 0, 1, 0, 1)
+	assert.NoError(t, m.Close(context.Background()))
+}
+
+func TestTransportOptionConnectionPoolLegacyDial(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	var host = server.Listener.Addr().String()
+
+	var dials int
+	var base = &http.Transport{Dial: func(network string, addr string) (net.Conn, error) {
+		dials++
+		return net.Dial(network, addr)
+	}}
+	var sender = NewMockXStater(ctrl)
+	var m = NewTransport(
+		TransportOptionConnectionPool(sender, time.Hour),
+		TransportOptionConnectionPoolNames("active", "idle", "dialing", "open"),
+	)(base).(*Transport)
+	var target, _ = url.Parse(server.URL)
+	var resp, e = m.RoundTrip(&http.Request{Method: http.MethodGet, URL: target, Header: http.Header{}})
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 1, dials)
+	expectPoolGauges(sender, host, 0, 1, 0, 1)
+	m.pool.flush()
+
+	// Closing the Transport reports the gauges one last time, stops the
+	// tracking, and closes the idle connections of the copied transport.
+	expectPoolGauges(sender, host, 0, 1, 0, 1)
+	assert.NoError(t, m.Close(context.Background()))
+	expectPoolGauges(sender, host, 0, 0, 0, 0)
+	m.pool.flush()
+}
+
+func TestTransportOptionConnectionPoolError(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var m = NewTransport(TransportOptionConnectionPool(sender, time.Hour))(&http.Transport{}).(*Transport)
+	defer m.Close(context.Background())
+	var listener, e = net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var host = listener.Addr().String()
+	listener.Close()
+
+	var target, _ = url.Parse("http://" + host + "/")
+	_, e = m.RoundTrip(&http.Request{Method: http.MethodGet, URL: target, Header: http.Header{}})
+	assert.Error(t, e)
+	var tag = "host:" + host
+	sender.EXPECT().Gauge("client_connections_active", float64(0), tag)
+	sender.EXPECT().Gauge("client_connections_idle", float64(0), tag)
+	sender.EXPECT().Gauge("client_connections_dialing", float64(0), tag)
+	sender.EXPECT().Gauge("client_connections_open", float64(0), tag)
+	m.pool.flush()
+}
+
+func TestTransportOptionConnectionPoolInvalid(t *testing.T) {
+	var m = NewTransport(
+		TransportOptionConnectionPool(nil, 0),
+		TransportOptionConnectionPoolNames("a", "b", "c", "d"),
+	)(http.DefaultTransport).(*Transport)
+	assert.Nil(t, m.pool)
+	assert.Equal(t, http.DefaultTransport, m.next)
+}
@@ -0,0 +1,281 @@
+package httpstats
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	prometheusCounter   = "counter"
+	prometheusGauge     = "gauge"
+	prometheusHistogram = "histogram"
+)
+
+var (
+	// defaultPrometheusTimingBuckets are the upper bounds, in seconds, of the
+	// histograms created for timers.
+	defaultPrometheusTimingBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// defaultPrometheusHistogramBuckets are the upper bounds of the histograms
+	// created for histogram stats. The standard histograms track byte counts
+	// so these range from 64B to 16MiB.
+	defaultPrometheusHistogramBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+)
+
+type prometheusSeries struct {
+	labels  string
+	bounds  []float64
+	value   float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+type prometheusFamily struct {
+	kind    string
+	buckets []float64
+	series  map[string]*prometheusSeries
+}
+
+// PrometheusSender is an xstats.Sender that aggregates all stats in memory and
+// exposes them, as an http.Handler, in the Prometheus text exposition format.
+// Counts are exposed as counters, gauges as gauges, and both timers and
+// histograms as histograms. Timer values are recorded in seconds. Tags in the
+// statsd "key:value" form are converted to labels and tags without a value
+// are converted to a label with the value "true". Metric and label names are
+// sanitized to match the Prometheus naming rules.
+type PrometheusSender struct {
+	lock             *sync.Mutex
+	families         map[string]*prometheusFamily
+	timingBuckets    []float64
+	histogramBuckets []float64
+}
+
+// PrometheusOption is used to configure the Prometheus sender.
+type PrometheusOption func(*PrometheusSender) *PrometheusSender
+
+// PrometheusOptionTimingBuckets sets the histogram bucket upper bounds, in
+// seconds, used for timers.
+func PrometheusOptionTimingBuckets(buckets ...float64) PrometheusOption {
+	return func(s *PrometheusSender) *PrometheusSender {
+		s.timingBuckets = sortedBuckets(buckets)
+		return s
+	}
+}
+
+// PrometheusOptionHistogramBuckets sets the histogram bucket upper bounds
+// used for histogram stats.
+func PrometheusOptionHistogramBuckets(buckets ...float64) PrometheusOption {
+	return func(s *PrometheusSender) *PrometheusSender {
+		s.histogramBuckets = sortedBuckets(buckets)
+		return s
+	}
+}
+
+func sortedBuckets(buckets []float64) []float64 {
+	var sorted = make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+	return sorted
+}
+
+// NewPrometheusSender configures and returns a Prometheus sender.
+func NewPrometheusSender(options ...PrometheusOption) *PrometheusSender {
+	var s = &PrometheusSender{
+		lock:             &sync.Mutex{},
+		families:         make(map[string]*prometheusFamily),
+		timingBuckets:    defaultPrometheusTimingBuckets,
+		histogramBuckets: defaultPrometheusHistogramBuckets,
+	}
+	for _, option := range options {
+		s = option(s)
+	}
+	return s
+}
+
+// series returns the series for the given stat and tags, creating it if
+// needed. Nil is returned if the stat has already been recorded as a
+// different type.
+func (s *PrometheusSender) series(stat string, kind string, buckets []float64, tags []string) *prometheusSeries {
+	var name = prometheusName(stat)
+	var family, ok = s.families[name]
+	if !ok {
+		family = &prometheusFamily{kind: kind, buckets: buckets, series: make(map[string]*prometheusSeries)}
+		s.families[name] = family
+	}
+	if family.kind != kind {
+		return nil
+	}
+	var labels = prometheusLabels(tags)
+	var series, found = family.series[labels]
+	if !found {
+		series = &prometheusSeries{labels: labels, bounds: family.buckets, buckets: make([]uint64, len(family.buckets))}
+		family.series[labels] = series
+	}
+	return series
+}
+
+func (s *PrometheusSender) observe(stat string, value float64, buckets []float64, tags []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var series = s.series(stat, prometheusHistogram, buckets, tags)
+	if series == nil {
+		return
+	}
+	// A family may be shared by a timer and a histogram of the same name so
+	// the buckets fixed when the series was created are used.
+	var offset = sort.SearchFloat64s(series.bounds, value)
+	if offset < len(series.buckets) {
+		series.buckets[offset] = series.buckets[offset] + 1
+	}
+	series.sum = series.sum + value
+	series.count = series.count + 1
+}
+
+// Gauge implements xstats.Sender interface
+func (s *PrometheusSender) Gauge(stat string, value float64, tags ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if series := s.series(stat, prometheusGauge, nil, tags); series != nil {
+		series.value = value
+	}
+}
+
+// Count implements xstats.Sender interface
+func (s *PrometheusSender) Count(stat string, count float64, tags ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if series := s.series(stat, prometheusCounter, nil, tags); series != nil {
+		series.value = series.value + count
+	}
+}
+
+// Histogram implements xstats.Sender interface
+func (s *PrometheusSender) Histogram(stat string, value float64, tags ...string) {
+	s.observe(stat, value, s.histogramBuckets, tags)
+}
+
+// Timing implements xstats.Sender interface
+func (s *PrometheusSender) Timing(stat string, value time.Duration, tags ...string) {
+	s.observe(stat, value.Seconds(), s.timingBuckets, tags)
+}
+
+// ServeHTTP renders all recorded metrics in the Prometheus text exposition
+// format.
+func (s *PrometheusSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf = &bytes.Buffer{}
+	s.render(buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+func (s *PrometheusSender) render(buf *bytes.Buffer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var names = make([]string, 0, len(s.families))
+	for name := range s.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var family = s.families[name]
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, family.kind)
+		var keys = make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			var series = family.series[key]
+			if family.kind != prometheusHistogram {
+				fmt.Fprintf(buf, "%s%s %s\n", name, braces(series.labels), prometheusFloat(series.value))
+				continue
+			}
+			var cumulative uint64
+			for offset, bound := range family.buckets {
+				cumulative = cumulative + series.buckets[offset]
+				fmt.Fprintf(buf, "%s_bucket%s %d\n", name, braces(joinLabels(series.labels, "le", prometheusFloat(bound))), cumulative)
+			}
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", name, braces(joinLabels(series.labels, "le", "+Inf")), series.count)
+			fmt.Fprintf(buf, "%s_sum%s %s\n", name, braces(series.labels), prometheusFloat(series.sum))
+			fmt.Fprintf(buf, "%s_count%s %d\n", name, braces(series.labels), series.count)
+		}
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func joinLabels(labels string, name string, value string) string {
+	var label = name + "=" + prometheusLabelValue(value)
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func prometheusFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// prometheusLabels converts statsd tags into a rendered, sorted label set.
+// The first value for a duplicated key is used.
+func prometheusLabels(tags []string) string {
+	var values = make(map[string]string, len(tags))
+	var names = make([]string, 0, len(tags))
+	for _, tag := range tags {
+		var key, value, found = strings.Cut(tag, ":")
+		if !found {
+			value = "true"
+		}
+		key = strings.ReplaceAll(prometheusName(key), ":", "_")
+		if _, ok := values[key]; ok {
+			continue
+		}
+		values[key] = value
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	var labels = make([]string, 0, len(names))
+	for _, name := range names {
+		labels = append(labels, name+"="+prometheusLabelValue(values[name]))
+	}
+	return strings.Join(labels, ",")
+}
+
+func prometheusLabelValue(value string) string {
+	var replacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// prometheusName replaces any characters that are not valid in a Prometheus
+// metric name with an underscore.
+func prometheusName(name string) string {
+	var output = []byte(name)
+	for offset, c := range output {
+		var valid = c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (offset > 0 && c >= '0' && c <= '9')
+		if !valid {
+			output[offset] = '_'
+		}
+	}
+	return string(output)
+}
+
+// MiddlewareOptionPrometheusSender enables emissions to a Prometheus sender.
+// The sender must be installed as an http.Handler on a route that is scraped
+// by Prometheus.
+func MiddlewareOptionPrometheusSender(sender *PrometheusSender) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.senders = append(m.senders, sender)
+		return m, nil
+	}
+}
@@ -0,0 +1,66 @@
+package httpstats
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusSender(t *testing.T) {
+	var sender = NewPrometheusSender(
+		PrometheusOptionTimingBuckets(1, 0.1),
+		PrometheusOptionHistogramBuckets(10, 100),
+	)
+	sender.Count("my.count", 1, "b:2", "a:1")
+	sender.Count("my.count", 2, "a:1", "b:2")
+	sender.Count("my.count", 1)
+	sender.Gauge("gauge", 3, "flag", `quoted:say "hi"`)
+	sender.Gauge("gauge", 5, "flag", `quoted:say "hi"`)
+	sender.Timing("time", 50*time.Millisecond, "server-method:GET")
+	sender.Timing("time", 2*time.Second, "server-method:GET")
+	sender.Histogram("bytes", 50)
+	// Stats of a conflicting type are dropped.
+	sender.Gauge("bytes", 1)
+
+	var recorder = httptest.NewRecorder()
+	sender.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var body, _ = io.ReadAll(recorder.Body)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, `# TYPE bytes histogram
+bytes_bucket{le="10"} 0
+bytes_bucket{le="100"} 1
+bytes_bucket{le="+Inf"} 1
+bytes_sum 50
+bytes_count 1
+# TYPE gauge gauge
+gauge{flag="true",quoted="say \"hi\""} 5
+# TYPE my_count counter
+my_count 1
+my_count{a="1",b="2"} 3
+# TYPE time histogram
+time_bucket{server_method="GET",le="0.1"} 1
+time_bucket{server_method="GET",le="1"} 1
+time_bucket{server_method="GET",le="+Inf"} 2
+time_sum{server_method="GET"} 2.05
+time_count{server_method="GET"} 2
+`, string(body))
+}
+
+func TestMiddlewareOptionPrometheusSender(t *testing.T) {
+	var sender = NewPrometheusSender()
+	var result, _, e = NewMiddleware(MiddlewareOptionPrometheusSender(sender), MiddlewareOptionTag(testName, testName))
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	result(fixtureHandler{}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var recorder = httptest.NewRecorder()
+	sender.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var body, _ = io.ReadAll(recorder.Body)
+	assert.Contains(t, string(body), `service_time_count{server_method="GET",server_status="ok",server_status_code="200",test="test"} 1`)
+	assert.Contains(t, string(body), `service_bytes_total_count{server_method="GET",server_status="ok",server_status_code="200",test="test"} 1`)
+}
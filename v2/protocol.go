@@ -0,0 +1,46 @@
+package httpstats
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// protocolTags returns the tags that describe the protocol and TLS session
+// of an incoming request.
+func protocolTags(r *http.Request) []string {
+	var tags = []string{fmt.Sprintf("server_protocol:%s", strings.ToLower(r.Proto))}
+	if r.TLS == nil {
+		return append(
+			tags,
+			"server_tls_version:none",
+			"server_cipher_suite:none",
+			"server_alpn:none",
+			"server_client_cert:false",
+		)
+	}
+	var protocol = r.TLS.NegotiatedProtocol
+	if protocol == "" {
+		protocol = "none"
+	}
+	return append(
+		tags,
+		fmt.Sprintf("server_tls_version:%s", tlsVersionName(r.TLS.Version)),
+		fmt.Sprintf("server_cipher_suite:%s", tls.CipherSuiteName(r.TLS.CipherSuite)),
+		fmt.Sprintf("server_alpn:%s", protocol),
+		fmt.Sprintf("server_client_cert:%v", len(r.TLS.PeerCertificates) > 0),
+	)
+}
+
+// MiddlewareOptionProtocolTags enables tagging of the standard metrics with
+// the server_protocol of the request, such as http/1.1 or http/2.0, and the
+// server_tls_version, server_cipher_suite, server_alpn, and
+// server_client_cert values of the TLS session. Requests received without
+// TLS are tagged with none and false.
+func MiddlewareOptionProtocolTags() MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.protocolTags = true
+		return m, nil
+	}
+}
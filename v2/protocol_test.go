@@ -0,0 +1,71 @@
+package httpstats
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func TestProtocolTags(t *testing.T) {
+	var r = httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Equal(t, []string{
+		"server_protocol:http/1.1",
+		"server_tls_version:none",
+		"server_cipher_suite:none",
+		"server_alpn:none",
+		"server_client_cert:false",
+	}, protocolTags(r))
+
+	r.Proto = "HTTP/2.0"
+	r.TLS = &tls.ConnectionState{
+		Version:            tls.VersionTLS13,
+		CipherSuite:        tls.TLS_AES_256_GCM_SHA384,
+		NegotiatedProtocol: "h2",
+		PeerCertificates:   []*x509.Certificate{{}},
+	}
+	assert.Equal(t, []string{
+		"server_protocol:http/2.0",
+		"server_tls_version:tls1.3",
+		"server_cipher_suite:TLS_AES_256_GCM_SHA384",
+		"server_alpn:h2",
+		"server_client_cert:true",
+	}, protocolTags(r))
+}
+
+func TestMiddlewareOptionProtocolTags(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionProtocolTags(),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(fixtureHandler{}).(*Middleware)
+
+	var r = httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	r.TLS.NegotiatedProtocol = "http/1.1"
+	var tags = []interface{}{
+		"server_method:GET",
+		"server_status_code:200",
+		"server_status:ok",
+		"server_protocol:http/1.1",
+		"server_tls_version:" + tlsVersionName(r.TLS.Version),
+		"server_cipher_suite:" + tls.CipherSuiteName(r.TLS.CipherSuite),
+		"server_alpn:http/1.1",
+		"server_client_cert:false",
+	}
+	sender.EXPECT().Timing(m.requestTime, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesIn, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesOut, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesTotal, gomock.Any(), tags...)
+	m.ServeHTTP(httptest.NewRecorder(), r)
+}
@@ -5,6 +5,8 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 // Copyright (c) 2015-present Peter Kieltyka (https://github.com/pkieltyka), Google Inc.
@@ -44,6 +46,25 @@ type writerProxy interface {
 	// io.Writer. It is illegal for the tee'd writer to be modified
 	// concurrently with writes.
 	Tee(io.Writer)
+	// HeaderTime returns the time at which the response headers were written,
+	// or the zero time if they have not yet been written.
+	HeaderTime() time.Time
+	// FirstWriteTime returns the time at which the first byte of the response
+	// body was written, or the zero time if nothing has been written.
+	FirstWriteTime() time.Time
+	// LastWriteTime returns the time at which the most recent bytes of the
+	// response body were written, or the zero time if nothing has been
+	// written.
+	LastWriteTime() time.Time
+	// OnFlush registers a function that is called each time the response is
+	// flushed.
+	OnFlush(func())
+	// OnHijack registers a function that is given the connection and buffers
+	// returned by a successful Hijack and may return replacements for them.
+	OnHijack(func(net.Conn, *bufio.ReadWriter) (net.Conn, *bufio.ReadWriter))
+	// OnWriteHeader registers a function that is called once when the
+	// response headers are first written.
+	OnWriteHeader(func())
 }
 
 // wrapWriter wraps an http.ResponseWriter, returning a proxy that allows you to
@@ -79,17 +100,53 @@ type basicWriter struct {
 	http.ResponseWriter
 	wroteHeader bool
 	code        int
-	bytes       int
+	bytes       int64
 	tee         io.Writer
+	headerTime  time.Time
+	firstWrite  time.Time
+	lastWrite   time.Time
+	flushHook   func()
+	headerHook  func()
+	hijackHook  func(net.Conn, *bufio.ReadWriter) (net.Conn, *bufio.ReadWriter)
 }
 
 func (b *basicWriter) WriteHeader(code int) {
 	if !b.wroteHeader {
 		b.code = code
 		b.wroteHeader = true
+		b.headerTime = time.Now()
+		b.headerWritten()
 		b.ResponseWriter.WriteHeader(code)
 	}
 }
+func (b *basicWriter) headerWritten() {
+	if b.headerHook != nil {
+		b.headerHook()
+		b.headerHook = nil
+	}
+}
+func (b *basicWriter) markFlushed() {
+	b.wroteHeader = true
+	if b.headerTime.IsZero() {
+		b.headerTime = time.Now()
+	}
+	b.headerWritten()
+	if b.flushHook != nil {
+		b.flushHook()
+	}
+}
+func (b *basicWriter) addBytes(n int) {
+	atomic.AddInt64(&b.bytes, int64(n))
+}
+func (b *basicWriter) markWritten(n int) {
+	if n < 1 {
+		return
+	}
+	b.lastWrite = time.Now()
+	if b.firstWrite.IsZero() {
+		b.firstWrite = b.lastWrite
+	}
+}
 func (b *basicWriter) Write(buf []byte) (int, error) {
 	b.WriteHeader(http.StatusOK)
 	n, err := b.ResponseWriter.Write(buf)
@@ -100,7 +157,8 @@ func (b *basicWriter) Write(buf []byte) (int, error) {
 			err = err2
 		}
 	}
-	b.bytes += n
+	b.addBytes(n)
+	b.markWritten(n)
 	return n, err
 }
 func (b *basicWriter) maybeWriteHeader() {
@@ -115,18 +173,36 @@ func (b *basicWriter) Status() int {
 	return b.code
 }
 func (b *basicWriter) BytesWritten() int {
-	return b.bytes
+	return int(atomic.LoadInt64(&b.bytes))
 }
 func (b *basicWriter) Tee(w io.Writer) {
 	b.tee = w
 }
+func (b *basicWriter) HeaderTime() time.Time {
+	return b.headerTime
+}
+func (b *basicWriter) FirstWriteTime() time.Time {
+	return b.firstWrite
+}
+func (b *basicWriter) LastWriteTime() time.Time {
+	return b.lastWrite
+}
+func (b *basicWriter) OnFlush(hook func()) {
+	b.flushHook = hook
+}
+func (b *basicWriter) OnWriteHeader(hook func()) {
+	b.headerHook = hook
+}
+func (b *basicWriter) OnHijack(hook func(net.Conn, *bufio.ReadWriter) (net.Conn, *bufio.ReadWriter)) {
+	b.hijackHook = hook
+}
 
 type flushWriter struct {
 	basicWriter
 }
 
 func (f *flushWriter) Flush() {
-	f.wroteHeader = true
+	f.markFlushed()
 
 	fl := f.basicWriter.ResponseWriter.(http.Flusher)
 	fl.Flush()
@@ -147,25 +223,29 @@ func (f *fancyWriter) CloseNotify() <-chan bool {
 	return cn.CloseNotify()
 }
 func (f *fancyWriter) Flush() {
-	f.wroteHeader = true
+	f.markFlushed()
 
 	fl := f.basicWriter.ResponseWriter.(http.Flusher)
 	fl.Flush()
 }
 func (f *fancyWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	hj := f.basicWriter.ResponseWriter.(http.Hijacker)
-	return hj.Hijack()
+	conn, rw, err := hj.Hijack()
+	if err == nil && f.basicWriter.hijackHook != nil {
+		conn, rw = f.basicWriter.hijackHook(conn, rw)
+	}
+	return conn, rw, err
 }
 func (f *fancyWriter) ReadFrom(r io.Reader) (int64, error) {
 	if f.basicWriter.tee != nil {
-		n, err := io.Copy(&f.basicWriter, r)
-		f.basicWriter.bytes += int(n)
-		return n, err
+		// The bytes are counted by basicWriter.Write.
+		return io.Copy(&f.basicWriter, r)
 	}
 	rf := f.basicWriter.ResponseWriter.(io.ReaderFrom)
 	f.basicWriter.maybeWriteHeader()
 	n, err := rf.ReadFrom(r)
-	f.basicWriter.bytes += int(n)
+	f.basicWriter.addBytes(int(n))
+	f.basicWriter.markWritten(int(n))
 	return n, err
 }
 
@@ -187,7 +267,7 @@ func (f *http2FancyWriter) CloseNotify() <-chan bool {
 	return cn.CloseNotify()
 }
 func (f *http2FancyWriter) Flush() {
-	f.wroteHeader = true
+	f.markFlushed()
 
 	fl := f.basicWriter.ResponseWriter.(http.Flusher)
 	fl.Flush()
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"reflect"
 	"testing"
+	"time"
 )
 
 type fixtureResponseWriter struct {
@@ -203,6 +204,48 @@ func TestBasicWriterCountsBytesWritten(t *testing.T) {
 	}
 }
 
+func TestBasicWriterRecordsWriteTimes(t *testing.T) {
+	var wrapped = &fixtureResponseWriter{}
+	var r = basicWriter{ResponseWriter: wrapped}
+	if !r.HeaderTime().IsZero() || !r.FirstWriteTime().IsZero() || !r.LastWriteTime().IsZero() {
+		t.Fatal("Expected zero times before writing.")
+	}
+
+	var before = time.Now()
+	r.WriteHeader(http.StatusOK)
+	var headerTime = r.HeaderTime()
+	if headerTime.Before(before) {
+		t.Fatal("Expected header time to be recorded.")
+	}
+	_, _ = r.Write([]byte(``))
+	if !r.FirstWriteTime().IsZero() {
+		t.Fatal("Expected empty writes to be ignored.")
+	}
+	_, _ = r.Write([]byte(`TEST`))
+	var firstWrite = r.FirstWriteTime()
+	if firstWrite.Before(headerTime) || !r.LastWriteTime().Equal(firstWrite) {
+		t.Fatal("Expected first and last write times to be recorded.")
+	}
+	_, _ = r.Write([]byte(`TEST`))
+	if !r.FirstWriteTime().Equal(firstWrite) || r.LastWriteTime().Before(firstWrite) {
+		t.Fatal("Expected only the last write time to change.")
+	}
+	r.WriteHeader(http.StatusOK)
+	if !r.HeaderTime().Equal(headerTime) {
+		t.Fatal("Expected header time to be recorded once.")
+	}
+}
+
+func TestFlushWriterRecordsHeaderTime(t *testing.T) {
+	var wrapped = fixtureFlusher{fixtureResponseWriter{}, false}
+	var r = wrapWriter(&wrapped, 1)
+
+	r.(http.Flusher).Flush()
+	if r.HeaderTime().IsZero() {
+		t.Fatal("Expected flushing to record the header time.")
+	}
+}
+
 func TestFancyWriterCloseNotify(t *testing.T) {
 	var base = fixtureResponseWriter{}
 	var wrapped = fixtureHTTPResponseWriter{
@@ -0,0 +1,224 @@
+package httpstats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/rs/xstats"
+)
+
+type attemptContextKey struct{}
+
+// WithAttempt returns a context that identifies the attempt number of a
+// request. Attempts are numbered from 1. The Transport tags the
+// client_request_time metric with the attempt when it is present.
+func WithAttempt(ctx context.Context, attempt int) context.Context {
+	return context.WithValue(ctx, attemptContextKey{}, attempt)
+}
+
+// AttemptFromContext returns the attempt number set with WithAttempt.
+func AttemptFromContext(ctx context.Context) (int, bool) {
+	var attempt, ok = ctx.Value(attemptContextKey{}).(int)
+	return attempt, ok
+}
+
+// RetryPolicy functions decide whether a request should be attempted again
+// given the response or error of the latest attempt.
+type RetryPolicy func(r *http.Request, resp *http.Response, err error) bool
+
+// RetryPolicyDefault retries idempotent requests that failed with an error
+// other than a context error or a *BreakerOpenError, or that received a 429,
+// 502, 503, or 504 response.
+func RetryPolicyDefault(r *http.Request, resp *http.Response, err error) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	if err != nil {
+		var breakerErr *BreakerOpenError
+		return r.Context().Err() == nil && !errors.As(err, &breakerErr)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Retry is an http.RoundTripper wrapper that retries failed requests and
+// instruments the logical request that covers all attempts.
+type Retry struct {
+	tags               []string
+	next               http.RoundTripper
+	maxAttempts        int
+	backoff            func(attempt int) time.Duration
+	policy             RetryPolicy
+	statusClassifier   StatusClassifier
+	retries            string
+	logicalRequestTime string
+}
+
+// RoundTrip sends the request, retrying it according to the policy, and
+// records the number of retries and the total duration.
+func (t *Retry) RoundTrip(r *http.Request) (*http.Response, error) {
+	var stat = xstats.FromRequest(r)
+	var ctx = r.Context()
+	var tags = make([]string, 0, len(t.tags)+4)
+	tags = append(tags, t.tags...)
+	tags = append(tags, fmt.Sprintf("method:%s", r.Method))
+	var start = time.Now()
+	var resp *http.Response
+	var e error
+	var attempt = 1
+	for ; ; attempt++ {
+		var req = r.WithContext(WithAttempt(ctx, attempt))
+		if attempt > 1 && r.Body != nil && r.Body != http.NoBody {
+			req.Body, e = r.GetBody()
+			if e != nil {
+				resp = nil
+				break
+			}
+		}
+		resp, e = t.next.RoundTrip(req)
+		if attempt >= t.maxAttempts || !t.canRetry(r) || !t.policy(r, resp, e) {
+			break
+		}
+		if !t.wait(ctx, attempt) {
+			break
+		}
+		if resp != nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		stat.Count(t.retries, 1, tags...)
+	}
+	var duration = time.Since(start)
+	var statusCode, status = roundTripOutcome(t.statusClassifier, r, resp, e)
+	tags = append(
+		tags,
+		fmt.Sprintf("status_code:%d", statusCode),
+		fmt.Sprintf("status:%s", status),
+		fmt.Sprintf("attempts:%d", attempt),
+	)
+	stat.Timing(t.logicalRequestTime, duration, tags...)
+	return resp, e
+}
+
+// canRetry reports whether the request body, if any, can be sent again.
+func (t *Retry) canRetry(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+}
+
+// wait blocks for the backoff of the given attempt and reports false if the
+// request context finished first.
+func (t *Retry) wait(ctx context.Context, attempt int) bool {
+	var timer = time.NewTimer(t.backoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// RetryOption is used to configure the retry middleware.
+type RetryOption func(*Retry) *Retry
+
+// RetryOptionTag adds a static key/value annotation to all metrics emitted by
+// the middleware.
+func RetryOptionTag(tagName string, tagValue string) RetryOption {
+	return func(m *Retry) *Retry {
+		m.tags = append(m.tags, fmt.Sprintf("%s:%s", tagName, tagValue))
+		return m
+	}
+}
+
+// RetryOptionMaxAttempts sets the maximum number of attempts, including the
+// first, made for each request. The default value is 3. Values less than 1
+// are ignored.
+func RetryOptionMaxAttempts(attempts int) RetryOption {
+	return func(m *Retry) *Retry {
+		if attempts > 0 {
+			m.maxAttempts = attempts
+		}
+		return m
+	}
+}
+
+// RetryOptionBackoff sets the function used to determine the delay after the
+// given attempt before the next attempt is made. The default doubles a delay
+// of 100ms after each attempt.
+func RetryOptionBackoff(backoff func(attempt int) time.Duration) RetryOption {
+	return func(m *Retry) *Retry {
+		m.backoff = backoff
+		return m
+	}
+}
+
+// RetryOptionPolicy sets the policy used to decide whether a request is
+// attempted again. The default is RetryPolicyDefault.
+func RetryOptionPolicy(policy RetryPolicy) RetryOption {
+	return func(m *Retry) *Retry {
+		m.policy = policy
+		return m
+	}
+}
+
+// RetryOptionStatusClassifier sets the classifier used to determine the
+// status tag of the logical request. The default is StatusClassifierDefault.
+func RetryOptionStatusClassifier(classifier StatusClassifier) RetryOption {
+	return func(m *Retry) *Retry {
+		m.statusClassifier = classifier
+		return m
+	}
+}
+
+// RetryOptionRetriesName sets the name of the metric used to count the number
+// of retried attempts. The default value is client_retries.
+func RetryOptionRetriesName(name string) RetryOption {
+	return func(m *Retry) *Retry {
+		m.retries = name
+		return m
+	}
+}
+
+// RetryOptionLogicalRequestTimeName sets the name of the metric used to track
+// the duration of a request across all attempts. The default value is
+// client_logical_request_time.
+func RetryOptionLogicalRequestTimeName(name string) RetryOption {
+	return func(m *Retry) *Retry {
+		m.logicalRequestTime = name
+		return m
+	}
+}
+
+// NewRetry configures and returns an HTTP retry middleware. The middleware
+// is intended to wrap a Transport so that each attempt is recorded
+// individually and tagged with its attempt number.
+func NewRetry(options ...RetryOption) func(http.RoundTripper) http.RoundTripper {
+	xstats.DisablePooling = true
+	return func(next http.RoundTripper) http.RoundTripper {
+		var m = &Retry{
+			next:        next,
+			maxAttempts: 3,
+			backoff: func(attempt int) time.Duration {
+				return 100 * time.Millisecond << uint(attempt-1)
+			},
+			policy:             RetryPolicyDefault,
+			statusClassifier:   StatusClassifierDefault,
+			retries:            "client_retries",
+			logicalRequestTime: "client_logical_request_time",
+		}
+		for _, option := range options {
+			m = option(m)
+		}
+		return m
+	}
+}
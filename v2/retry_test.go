@@ -0,0 +1,129 @@
+package httpstats
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/xstats"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func TestAttemptFromContext(t *testing.T) {
+	var _, ok = AttemptFromContext(context.Background())
+	assert.False(t, ok)
+	var attempt int
+	attempt, ok = AttemptFromContext(WithAttempt(context.Background(), 2))
+	assert.True(t, ok)
+	assert.Equal(t, 2, attempt)
+}
+
+func TestRetryPolicyDefault(t *testing.T) {
+	var get = httptest.NewRequest(http.MethodGet, "/", nil)
+	var post = httptest.NewRequest(http.MethodPost, "/", nil)
+	assert.True(t, RetryPolicyDefault(get, &http.Response{StatusCode: http.StatusServiceUnavailable}, nil))
+	assert.True(t, RetryPolicyDefault(get, nil, errors.New("connection refused")))
+	assert.False(t, RetryPolicyDefault(get, &http.Response{StatusCode: http.StatusNotFound}, nil))
+	assert.False(t, RetryPolicyDefault(post, &http.Response{StatusCode: http.StatusServiceUnavailable}, nil))
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, RetryPolicyDefault(get.WithContext(ctx), nil, context.Canceled))
+}
+
+func TestRetry(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var stat = xstats.New(sender)
+	var attempts []int
+	var bodies []string
+	var next = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		var attempt, _ = AttemptFromContext(r.Context())
+		attempts = append(attempts, attempt)
+		var body, _ = ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		var statusCode = http.StatusServiceUnavailable
+		if attempt == 3 {
+			statusCode = http.StatusOK
+		}
+		return &http.Response{StatusCode: statusCode, Body: ioutil.NopCloser(bytes.NewBufferString(``))}, nil
+	})
+	var r = NewRetry(
+		RetryOptionTag(testName, testName),
+		RetryOptionBackoff(func(int) time.Duration { return 0 }),
+		RetryOptionRetriesName("retries"),
+		RetryOptionLogicalRequestTimeName("logical"),
+	)(next)
+
+	sender.EXPECT().Count("retries", float64(1), "test:test", "method:PUT").Times(2)
+	sender.EXPECT().Timing("logical", gomock.Any(), "test:test", "method:PUT", "status_code:200", "status:ok", "attempts:3")
+	var req, _ = http.NewRequest(http.MethodPut, "http://localhost/", strings.NewReader("body"))
+	req = req.WithContext(xstats.NewContext(context.Background(), stat))
+	var resp, e = r.RoundTrip(req)
+	assert.NoError(t, e)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []int{1, 2, 3}, attempts)
+	assert.Equal(t, []string{"body", "body", "body"}, bodies)
+}
+
+func TestRetryExhausted(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var stat = xstats.New(sender)
+	var next = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+	var r = NewRetry(
+		RetryOptionMaxAttempts(2),
+		RetryOptionBackoff(func(int) time.Duration { return 0 }),
+		RetryOptionStatusClassifier(StatusClassifierClass),
+	)(next)
+
+	sender.EXPECT().Count("client_retries", float64(1), "method:GET")
+	sender.EXPECT().Timing("client_logical_request_time", gomock.Any(), "method:GET", "status_code:502", "status:server_error", "attempts:2")
+	var req = httptest.NewRequest(http.MethodGet, "/", nil).WithContext(xstats.NewContext(context.Background(), stat))
+	var _, e = r.RoundTrip(req)
+	assert.Error(t, e)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var stat = xstats.New(sender)
+	var r = NewRetry(RetryOptionPolicy(func(*http.Request, *http.Response, error) bool {
+		return false
+	}))(statusTransport(http.StatusServiceUnavailable))
+
+	sender.EXPECT().Timing("client_logical_request_time", gomock.Any(), "method:GET", "status_code:503", "status:error", "attempts:1")
+	var req = httptest.NewRequest(http.MethodGet, "/", nil).WithContext(xstats.NewContext(context.Background(), stat))
+	var _, e = r.RoundTrip(req)
+	assert.NoError(t, e)
+}
+
+func TestTransportAttemptTag(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var stat = xstats.New(sender)
+	var r = NewTransport()(statusTransport(http.StatusOK))
+
+	sender.EXPECT().Timing("client_request_time", gomock.Any(), "method:GET", "status_code:200", "status:ok", "attempt:2")
+	sender.EXPECT().Histogram("client_request_bytes_received", gomock.Any())
+	var ctx = WithAttempt(xstats.NewContext(context.Background(), stat), 2)
+	var _, e = r.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	assert.NoError(t, e)
+}
@@ -0,0 +1,79 @@
+package httpstats
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	routeTagName   = "server_route"
+	unmatchedRoute = "unmatched"
+)
+
+// RouteExtractor functions resolve the route template, such as
+// "/users/{id}", that matched an incoming request. The boolean return value
+// must be false if the request did not match any route known to the
+// extractor. Extractors are evaluated by the Middleware after the wrapped
+// handler has returned so that any routing state populated by the router is
+// available. Extractors for gorilla/mux, chi, and httprouter are provided by
+// the route/gorillamux, route/chi, and route/httprouter packages so that
+// only the routers in use are imported.
+type RouteExtractor func(*http.Request) (string, bool)
+
+// RouteExtractorServeMux resolves routes registered with an http.ServeMux
+// using the Go 1.22 pattern syntax. The request Pattern field is used when it
+// has been populated by the mux. Otherwise, the given mux is consulted
+// directly which allows the middleware to wrap the mux rather than being
+// installed within it. The mux may be nil if only the Pattern field should be
+// used. Any method or host portion of the pattern is removed because those
+// values are reported through other tags.
+func RouteExtractorServeMux(sm *http.ServeMux) RouteExtractor {
+	return func(r *http.Request) (string, bool) {
+		var pattern = r.Pattern
+		if pattern == "" && sm != nil {
+			_, pattern = sm.Handler(r)
+		}
+		if pattern == "" {
+			return "", false
+		}
+		// Patterns take the form "[METHOD ][HOST]/[PATH]".
+		if offset := strings.IndexAny(pattern, " \t"); offset >= 0 {
+			pattern = strings.TrimLeft(pattern[offset:], " \t")
+		}
+		if offset := strings.Index(pattern, "/"); offset > 0 {
+			pattern = pattern[offset:]
+		}
+		return pattern, true
+	}
+}
+
+// MiddlewareOptionRouteTag enables the server_route tag on all metrics
+// emitted by the middleware for a request. The extractors are tried in order
+// and the first match is used. Requests that match none of the extractors are
+// tagged with "unmatched" so that raw URL paths are never used as tag values.
+func MiddlewareOptionRouteTag(extractors ...RouteExtractor) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.routeExtractors = append(m.routeExtractors, extractors...)
+		return m, nil
+	}
+}
+
+// route returns the template of the route matched by the request or the
+// unmatched token if no extractor recognizes the request.
+func (m *Middleware) route(r *http.Request) string {
+	if template, ok := m.matchRoute(r); ok {
+		return template
+	}
+	return unmatchedRoute
+}
+
+// matchRoute returns the template of the first extractor that recognizes the
+// request.
+func (m *Middleware) matchRoute(r *http.Request) (string, bool) {
+	for _, extractor := range m.routeExtractors {
+		if template, ok := extractor(r); ok {
+			return template, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,37 @@
+// Package chi resolves the route templates of requests handled by a chi
+// router for the server_route tag of httpstats.
+package chi
+
+import (
+	"net/http"
+
+	"github.com/asecurityteam/httpstats/v2"
+	"github.com/go-chi/chi/v5"
+)
+
+// Extractor resolves routes registered with a chi router. When the
+// middleware is installed with Router.Use the route pattern is read from the
+// chi routing context of the request. Otherwise, the given router is used to
+// find the matching pattern. The router may be nil if the middleware is always
+// installed within the router.
+func Extractor(router chi.Routes) httpstats.RouteExtractor {
+	return func(r *http.Request) (string, bool) {
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			if pattern := rctx.RoutePattern(); pattern != "" {
+				return pattern, true
+			}
+		}
+		if router == nil {
+			return "", false
+		}
+		var path = r.URL.RawPath
+		if path == "" {
+			path = r.URL.Path
+		}
+		var pattern = router.Find(chi.NewRouteContext(), r.Method, path)
+		if pattern == "" {
+			return "", false
+		}
+		return pattern, true
+	}
+}
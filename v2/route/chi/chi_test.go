@@ -0,0 +1,33 @@
+package chi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractor(t *testing.T) {
+	var router = chi.NewRouter()
+	var inner string
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r)
+			inner, _ = Extractor(nil)(r)
+		})
+	})
+	router.Get("/users/{id}", func(http.ResponseWriter, *http.Request) {})
+	var extractor = Extractor(router)
+
+	var route, ok = extractor(httptest.NewRequest(http.MethodGet, "/users/1234", nil))
+	assert.True(t, ok)
+	assert.Equal(t, "/users/{id}", route)
+
+	_, ok = extractor(httptest.NewRequest(http.MethodGet, "/missing", nil))
+	assert.False(t, ok)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/1234", nil))
+	assert.Equal(t, "/users/{id}", inner)
+}
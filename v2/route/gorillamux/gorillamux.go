@@ -0,0 +1,34 @@
+// Package gorillamux resolves the route templates of requests handled by a
+// gorilla/mux Router for the server_route tag of httpstats.
+package gorillamux
+
+import (
+	"net/http"
+
+	"github.com/asecurityteam/httpstats/v2"
+	"github.com/gorilla/mux"
+)
+
+// Extractor resolves routes registered with a gorilla/mux Router. When the
+// middleware is installed with Router.Use the current route is read from the
+// request. Otherwise, the given router is used to match the request. The
+// router may be nil if the middleware is always installed within the router.
+func Extractor(router *mux.Router) httpstats.RouteExtractor {
+	return func(r *http.Request) (string, bool) {
+		var route = mux.CurrentRoute(r)
+		if route == nil && router != nil {
+			var match mux.RouteMatch
+			if router.Match(r, &match) {
+				route = match.Route
+			}
+		}
+		if route == nil {
+			return "", false
+		}
+		var template, e = route.GetPathTemplate()
+		if e != nil || template == "" {
+			return "", false
+		}
+		return template, true
+	}
+}
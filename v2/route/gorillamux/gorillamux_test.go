@@ -0,0 +1,33 @@
+package gorillamux
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractor(t *testing.T) {
+	var router = mux.NewRouter()
+	router.HandleFunc("/users/{id}", func(http.ResponseWriter, *http.Request) {}).Methods(http.MethodGet)
+	var extractor = Extractor(router)
+
+	var route, ok = extractor(httptest.NewRequest(http.MethodGet, "/users/1234", nil))
+	assert.True(t, ok)
+	assert.Equal(t, "/users/{id}", route)
+
+	_, ok = extractor(httptest.NewRequest(http.MethodGet, "/missing", nil))
+	assert.False(t, ok)
+
+	var inner string
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inner, _ = Extractor(nil)(r)
+			next.ServeHTTP(w, r)
+		})
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/1234", nil))
+	assert.Equal(t, "/users/{id}", inner)
+}
@@ -0,0 +1,95 @@
+// Package httprouter resolves the route templates of requests handled by an
+// httprouter Router for the server_route tag of httpstats.
+package httprouter
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/asecurityteam/httpstats/v2"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Extractor resolves routes registered with an httprouter Router. The
+// httprouter package does not record the matched route so the template is
+// reconstructed from the path parameters of the match and then verified
+// against the router. Requests for which the template cannot be recovered are
+// reported as unmatched. Unlike the other extractors the router is always
+// consulted so it is required and Extractor panics if it is nil.
+func Extractor(router *httprouter.Router) httpstats.RouteExtractor {
+	if router == nil {
+		panic("httprouter route extractor requires a router")
+	}
+	return func(r *http.Request) (string, bool) {
+		var handle, params, _ = router.Lookup(r.Method, r.URL.Path)
+		if handle == nil {
+			return "", false
+		}
+		// A literal segment may have the same value as a parameter so the
+		// template is built scanning in both directions and the first one
+		// that resolves back to the matched route wins.
+		for _, reverse := range []bool{false, true} {
+			var template = routeTemplate(r.URL.Path, params, reverse)
+			if verify(router, r.Method, template, params) {
+				return template, true
+			}
+		}
+		return "", false
+	}
+}
+
+func placeholder(param httprouter.Param) string {
+	if strings.HasPrefix(param.Value, "/") {
+		return "*" + param.Key
+	}
+	return ":" + param.Key
+}
+
+// routeTemplate rebuilds a route template by replacing the path segments
+// that were bound to parameters with the parameter placeholders. Segments are
+// matched to parameters from the start of the path or, if reverse is set, from
+// the end of the path.
+func routeTemplate(path string, params httprouter.Params, reverse bool) string {
+	var suffix string
+	if len(params) > 0 && strings.HasPrefix(params[len(params)-1].Value, "/") {
+		// Catch-all parameters are always last and consume the remainder of
+		// the path.
+		var param = params[len(params)-1]
+		path = strings.TrimSuffix(path, param.Value) + "/"
+		suffix = placeholder(param)
+		params = params[:len(params)-1]
+	}
+	var segments = strings.Split(path, "/")
+	for x := 0; x < len(params); x = x + 1 {
+		var param = params[x]
+		if reverse {
+			param = params[len(params)-1-x]
+		}
+		for y := 0; y < len(segments); y = y + 1 {
+			var offset = y
+			if reverse {
+				offset = len(segments) - 1 - y
+			}
+			if segments[offset] == param.Value {
+				segments[offset] = placeholder(param)
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/") + suffix
+}
+
+// verify checks that looking up the template itself resolves to a route with
+// each parameter bound to its own placeholder.
+func verify(router *httprouter.Router, method string, template string, params httprouter.Params) bool {
+	var handle, templateParams, _ = router.Lookup(method, template)
+	if handle == nil || len(templateParams) != len(params) {
+		return false
+	}
+	for offset, param := range templateParams {
+		if param.Key != params[offset].Key || strings.TrimPrefix(param.Value, "/") != placeholder(params[offset]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package httprouter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractor(t *testing.T) {
+	var handle = func(http.ResponseWriter, *http.Request, httprouter.Params) {}
+	var router = httprouter.New()
+	router.GET("/users/:id", handle)
+	router.GET("/users/:id/groups/:group", handle)
+	router.GET("/files/*filepath", handle)
+	router.GET("/static/users", handle)
+	var extractor = Extractor(router)
+
+	var cases = map[string]string{
+		"/users/1234":           "/users/:id",
+		"/users/users":          "/users/:id",
+		"/users/1234/groups/42": "/users/:id/groups/:group",
+		"/files/a/b/c.txt":      "/files/*filepath",
+		"/files/":               "/files/*filepath",
+		"/static/users":         "/static/users",
+	}
+	for path, expected := range cases {
+		var route, ok = extractor(httptest.NewRequest(http.MethodGet, path, nil))
+		assert.True(t, ok, path)
+		assert.Equal(t, expected, route, path)
+	}
+
+	var _, ok = extractor(httptest.NewRequest(http.MethodGet, "/missing", nil))
+	assert.False(t, ok)
+	_, ok = extractor(httptest.NewRequest(http.MethodPost, "/users/1234", nil))
+	assert.False(t, ok)
+}
+
+func TestExtractorNilRouter(t *testing.T) {
+	assert.Panics(t, func() { Extractor(nil) })
+}
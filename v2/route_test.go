@@ -0,0 +1,67 @@
+package httpstats
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func TestRouteExtractorServeMux(t *testing.T) {
+	var sm = http.NewServeMux()
+	sm.Handle("GET /users/{id}", fixtureHandler{})
+	sm.Handle("example.com/hosts/{id}", fixtureHandler{})
+	var extractor = RouteExtractorServeMux(sm)
+
+	var route, ok = extractor(httptest.NewRequest(http.MethodGet, "/users/1234", nil))
+	assert.True(t, ok)
+	assert.Equal(t, "/users/{id}", route)
+
+	route, ok = extractor(httptest.NewRequest(http.MethodGet, "http://example.com/hosts/1234", nil))
+	assert.True(t, ok)
+	assert.Equal(t, "/hosts/{id}", route)
+
+	_, ok = extractor(httptest.NewRequest(http.MethodGet, "/missing", nil))
+	assert.False(t, ok)
+
+	var r = httptest.NewRequest(http.MethodGet, "/missing", nil)
+	r.Pattern = "POST /things/{id}"
+	route, ok = RouteExtractorServeMux(nil)(r)
+	assert.True(t, ok)
+	assert.Equal(t, "/things/{id}", route)
+}
+
+func TestMiddlewareOptionRouteTag(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionRouteTag(RouteExtractorServeMux(nil)),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var sm = http.NewServeMux()
+	sm.Handle("GET /users/{id}", fixtureHandler{})
+	var m = result(sm).(*Middleware)
+
+	var tags = []interface{}{"server_method:GET", "server_status_code:200", "server_status:ok", "server_route:/users/{id}"}
+	sender.EXPECT().Timing(m.requestTime, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesIn, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesOut, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesTotal, gomock.Any(), tags...)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/1234", nil))
+
+	tags = []interface{}{"server_method:GET", "server_status_code:404", "server_status:error", "server_route:unmatched"}
+	sender.EXPECT().Timing(m.requestTime, gomock.Any(), tags...)
+	sender.EXPECT().Timing(m.timeToHeaders, gomock.Any(), tags...)
+	sender.EXPECT().Timing(m.timeToFirstByte, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesIn, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesOut, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesTotal, gomock.Any(), tags...)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+}
@@ -0,0 +1,97 @@
+package httpstats
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/xstats"
+)
+
+// SLO defines a service level objective that is evaluated for each request
+// handled by the Middleware. A request is counted as good if its status is
+// one of the GoodStatuses and, if LatencyThreshold is not zero, it completed
+// within the threshold.
+type SLO struct {
+	// Name is used as the value of the slo tag.
+	Name string
+	// LatencyThreshold is the maximum duration of a good request. A zero value
+	// disables the latency requirement.
+	LatencyThreshold time.Duration
+	// GoodStatuses are the server_status values that are counted as good.
+	// Only ok is counted as good if this is empty.
+	GoodStatuses []string
+	// Match selects the requests that are counted against the objective. All
+	// requests are counted if this is nil.
+	Match func(*http.Request) bool
+}
+
+type sloDefinition struct {
+	SLO
+	good map[string]bool
+}
+
+// SLOMatchRoutes returns a matcher for use with SLO that selects requests for
+// which the extractor resolves one of the given routes.
+func SLOMatchRoutes(extractor RouteExtractor, routes ...string) func(*http.Request) bool {
+	var lookup = make(map[string]bool, len(routes))
+	for _, route := range routes {
+		lookup[route] = true
+	}
+	return func(r *http.Request) bool {
+		var route, ok = extractor(r)
+		return ok && lookup[route]
+	}
+}
+
+// recordSLOs emits the total and good counters for each objective that
+// matches the request.
+func (m *Middleware) recordSLOs(r *http.Request, duration time.Duration, status string) {
+	for _, slo := range m.slos {
+		if slo.Match != nil && !slo.Match(r) {
+			continue
+		}
+		var tag = fmt.Sprintf("slo:%s", slo.Name)
+		xstats.FromRequest(r).Count(m.sloTotal, 1, tag)
+		if slo.good[status] && (slo.LatencyThreshold == 0 || duration <= slo.LatencyThreshold) {
+			xstats.FromRequest(r).Count(m.sloGood, 1, tag)
+		}
+	}
+}
+
+// MiddlewareOptionSLO adds service level objectives to the Middleware. For
+// each request that matches an objective a service_slo_total counter is
+// emitted and, if the request meets the objective, a service_slo_good counter
+// is emitted. Both are tagged with the slo name. This option may be given
+// more than once.
+func MiddlewareOptionSLO(slos ...SLO) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		for _, slo := range slos {
+			if slo.Name == "" {
+				return nil, fmt.Errorf("slo name must not be empty")
+			}
+			if slo.LatencyThreshold < 0 {
+				return nil, fmt.Errorf("slo %s latency threshold must not be negative: %s", slo.Name, slo.LatencyThreshold)
+			}
+			var good = make(map[string]bool, len(slo.GoodStatuses))
+			for _, status := range slo.GoodStatuses {
+				good[status] = true
+			}
+			if len(good) < 1 {
+				good["ok"] = true
+			}
+			m.slos = append(m.slos, sloDefinition{SLO: slo, good: good})
+		}
+		return m, nil
+	}
+}
+
+// MiddlewareOptionSLONames sets the metric names used for the SLO counters.
+// The default values are service_slo_total and service_slo_good.
+func MiddlewareOptionSLONames(totalName string, goodName string) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.sloTotal = totalName
+		m.sloGood = goodName
+		return m, nil
+	}
+}
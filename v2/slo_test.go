@@ -0,0 +1,68 @@
+package httpstats
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func TestSLOMatchRoutes(t *testing.T) {
+	var sm = http.NewServeMux()
+	sm.Handle("GET /users/{id}", fixtureHandler{})
+	sm.Handle("GET /groups/{id}", fixtureHandler{})
+	var match = SLOMatchRoutes(RouteExtractorServeMux(sm), "/users/{id}")
+	assert.True(t, match(httptest.NewRequest(http.MethodGet, "/users/1", nil)))
+	assert.False(t, match(httptest.NewRequest(http.MethodGet, "/groups/1", nil)))
+	assert.False(t, match(httptest.NewRequest(http.MethodGet, "/missing", nil)))
+}
+
+func TestMiddlewareOptionSLO(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionSLO(
+			SLO{Name: "availability"},
+			SLO{Name: "latency", LatencyThreshold: time.Millisecond},
+			SLO{Name: "lookup", GoodStatuses: []string{"ok", errorName}, Match: func(r *http.Request) bool {
+				return r.URL.Path == "/lookup"
+			}},
+		),
+		MiddlewareOptionSLONames("slo_total", "slo_good"),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		if r.URL.Path == "/lookup" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})).(*Middleware)
+
+	sender.EXPECT().Timing(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	sender.EXPECT().Histogram(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	sender.EXPECT().Count("slo_total", float64(1), "slo:availability")
+	sender.EXPECT().Count("slo_good", float64(1), "slo:availability")
+	sender.EXPECT().Count("slo_total", float64(1), "slo:latency")
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	sender.EXPECT().Count("slo_total", float64(1), "slo:availability")
+	sender.EXPECT().Count("slo_total", float64(1), "slo:latency")
+	sender.EXPECT().Count("slo_total", float64(1), "slo:lookup")
+	sender.EXPECT().Count("slo_good", float64(1), "slo:lookup")
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/lookup", nil))
+}
+
+func TestMiddlewareOptionSLOInvalid(t *testing.T) {
+	var _, _, e = NewMiddleware(MiddlewareOptionSLO(SLO{}))
+	assert.Error(t, e)
+	_, _, e = NewMiddleware(MiddlewareOptionSLO(SLO{Name: "latency", LatencyThreshold: -time.Second}))
+	assert.Error(t, e)
+}
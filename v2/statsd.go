@@ -0,0 +1,302 @@
+package httpstats
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FlushCloser is implemented by values that buffer metrics or run background
+// work that must be drained before a process exits.
+type FlushCloser interface {
+	// Flush writes any buffered metrics. The context bounds how long the
+	// write may take.
+	Flush(ctx context.Context) error
+	// Close stops any background work and flushes the remaining metrics.
+	// Metrics recorded after Close are dropped.
+	Close(ctx context.Context) error
+}
+
+const (
+	// udpMaxPacketSize fits a statsd packet within the common MTU of 1500
+	// bytes after IP and UDP headers.
+	udpMaxPacketSize = 1432
+	// unixMaxPacketSize matches the default buffer size of the datadog agent
+	// for unix domain sockets.
+	unixMaxPacketSize = 8192
+	// unixWriteTimeout bounds how long a write to a unix domain socket may
+	// block when the agent is not reading.
+	unixWriteTimeout = 100 * time.Millisecond
+)
+
+// statsdNetwork returns the network and address to dial for the address of a
+// statsd agent. Addresses using the unix:// or unixgram:// schemes are dialed
+// as unix datagram sockets. Other addresses, including those using the udp://
+// scheme, are dialed over UDP.
+func statsdNetwork(address string) (string, string) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return "unixgram", strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "unixgram://"):
+		return "unixgram", strings.TrimPrefix(address, "unixgram://")
+	}
+	return "udp", strings.TrimPrefix(address, "udp://")
+}
+
+// statsdPacketSize returns the given packet size or, if it is less than or
+// equal to zero, the default for the network.
+func statsdPacketSize(network string, maxPacketSize int) int {
+	switch {
+	case maxPacketSize > 0:
+		return maxPacketSize
+	case network == "udp":
+		return udpMaxPacketSize
+	}
+	return unixMaxPacketSize
+}
+
+// StatsdSender is an xstats.Sender that emits metrics using the datadog
+// extensions to the statsd line protocol. Metrics are buffered until the
+// buffer reaches the maximum packet size or the flush interval elapses,
+// whichever comes first.
+type StatsdSender struct {
+	writer        io.Writer
+	maxPacketSize int
+	interval      time.Duration
+	prefix        string
+	synchronous   bool
+	writeTimeout  time.Duration
+	lock          *sync.Mutex
+	buf           *bytes.Buffer
+	closed        bool
+	started       bool
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+// StatsdOption is used to configure a StatsdSender.
+type StatsdOption func(*StatsdSender) *StatsdSender
+
+// StatsdOptionPrefix prepends the prefix to the name of every metric.
+func StatsdOptionPrefix(prefix string) StatsdOption {
+	return func(s *StatsdSender) *StatsdSender {
+		s.prefix = prefix
+		return s
+	}
+}
+
+// StatsdOptionSynchronous writes each metric before the call that records it
+// returns rather than buffering it. This is intended for short lived
+// processes, such as CLIs and batch jobs, that may exit before a flush
+// interval elapses. No background work is started in this mode.
+func StatsdOptionSynchronous() StatsdOption {
+	return func(s *StatsdSender) *StatsdSender {
+		s.synchronous = true
+		return s
+	}
+}
+
+// NewStatsdSender creates a StatsdSender that writes to the given writer. A
+// flush interval less than or equal to zero disables periodic flushing. The
+// writer is not closed by the sender.
+func NewStatsdSender(w io.Writer, maxPacketSize int, flushInterval time.Duration, options ...StatsdOption) *StatsdSender {
+	var s = newStatsdSender(w, maxPacketSize, flushInterval)
+	for _, option := range options {
+		s = option(s)
+	}
+	s.start()
+	return s
+}
+
+// newStatsdSender creates a sender without starting its background flushing
+// so that the Middleware may configure it first.
+func newStatsdSender(w io.Writer, maxPacketSize int, flushInterval time.Duration) *StatsdSender {
+	return &StatsdSender{
+		writer:        w,
+		maxPacketSize: maxPacketSize,
+		interval:      flushInterval,
+		lock:          &sync.Mutex{},
+		buf:           &bytes.Buffer{},
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+func (s *StatsdSender) start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started || s.synchronous || s.interval <= 0 {
+		return
+	}
+	s.started = true
+	go s.run()
+}
+
+func (s *StatsdSender) run() {
+	defer close(s.done)
+	var ticker = time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.lock.Lock()
+			logStatsdError(s.flush(context.Background()))
+			s.lock.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func logStatsdError(e error) {
+	if e != nil {
+		log.Printf("error: could not write to statsd: %v", e)
+	}
+}
+
+// statsdTags generates the datadog tag suffix of a line.
+func statsdTags(tags []string) string {
+	if len(tags) < 1 {
+		return ""
+	}
+	return "|#" + strings.Join(tags, ",")
+}
+
+// statsdLine formats a single newline terminated metric.
+func statsdLine(prefix string, stat string, value float64, kind string, tags []string) string {
+	return fmt.Sprintf("%s%s:%f|%s%s\n", prefix, stat, value, kind, statsdTags(tags))
+}
+
+// statsdValueLines formats several samples of a metric as newline terminated
+// multi-value lines, such as name:1.000000:2.000000|h. Each line holds as
+// many values as fit within maxSize bytes and at least one value.
+func statsdValueLines(prefix string, stat string, values []float64, kind string, tags []string, maxSize int) []string {
+	if kind == timingDistributionKind {
+		kind = "d"
+	}
+	var head = prefix + stat
+	var tail = "|" + kind + statsdTags(tags) + "\n"
+	var lines []string
+	var line = &strings.Builder{}
+	for _, value := range values {
+		var formatted = fmt.Sprintf(":%f", value)
+		if line.Len() > 0 && len(head)+line.Len()+len(formatted)+len(tail) > maxSize {
+			lines = append(lines, head+line.String()+tail)
+			line.Reset()
+		}
+		line.WriteString(formatted)
+	}
+	if line.Len() > 0 {
+		lines = append(lines, head+line.String()+tail)
+	}
+	return lines
+}
+
+func (s *StatsdSender) send(stat string, value float64, kind string, tags []string) {
+	s.sendLines(statsdLine(s.prefix, stat, value, kind, tags))
+}
+
+func (s *StatsdSender) sendValues(stat string, values []float64, kind string, tags []string) {
+	s.sendLines(statsdValueLines(s.prefix, stat, values, kind, tags, s.maxPacketSize)...)
+}
+
+func (s *StatsdSender) sendLines(lines ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	for _, line := range lines {
+		if s.buf.Len()+len(line) > s.maxPacketSize {
+			logStatsdError(s.flush(context.Background()))
+		}
+		s.buf.WriteString(line)
+		if s.synchronous || s.buf.Len() >= s.maxPacketSize {
+			logStatsdError(s.flush(context.Background()))
+		}
+	}
+}
+
+// flush must be called with the lock held.
+func (s *StatsdSender) flush(ctx context.Context) error {
+	if s.buf.Len() < 1 {
+		return nil
+	}
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	if conn, ok := s.writer.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		var deadline, ok = ctx.Deadline()
+		if !ok && s.writeTimeout > 0 {
+			deadline, ok = time.Now().Add(s.writeTimeout), true
+		}
+		if ok {
+			_ = conn.SetWriteDeadline(deadline)
+			defer func() { _ = conn.SetWriteDeadline(time.Time{}) }()
+		}
+	}
+	var _, e = s.writer.Write(s.buf.Bytes())
+	s.buf.Reset()
+	return e
+}
+
+// Gauge implements the xstats.Sender interface.
+func (s *StatsdSender) Gauge(stat string, value float64, tags ...string) {
+	s.send(stat, value, "g", tags)
+}
+
+// Count implements the xstats.Sender interface.
+func (s *StatsdSender) Count(stat string, count float64, tags ...string) {
+	s.send(stat, count, "c", tags)
+}
+
+// Histogram implements the xstats.Sender interface.
+func (s *StatsdSender) Histogram(stat string, value float64, tags ...string) {
+	s.send(stat, value, "h", tags)
+}
+
+// Timing implements the xstats.Sender interface.
+func (s *StatsdSender) Timing(stat string, duration time.Duration, tags ...string) {
+	s.send(stat, duration.Seconds()*1000, "ms", tags)
+}
+
+// Distribution implements the DistributionSender interface.
+func (s *StatsdSender) Distribution(stat string, value float64, tags ...string) {
+	s.send(stat, value, "d", tags)
+}
+
+// Flush writes any buffered metrics. If the writer supports write deadlines
+// then the deadline of the context is applied to the write.
+func (s *StatsdSender) Flush(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.flush(ctx)
+}
+
+// Close stops the periodic flushing and writes any buffered metrics. Metrics
+// recorded after Close are dropped. Calling Close more than once has no
+// effect.
+func (s *StatsdSender) Close(ctx context.Context) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	var started = s.started
+	s.lock.Unlock()
+	if started {
+		close(s.stop)
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return s.Flush(ctx)
+}
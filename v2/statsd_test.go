@@ -0,0 +1,187 @@
+package httpstats
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// packetWriter records each write as a separate packet.
+type packetWriter struct {
+	lock    *sync.Mutex
+	packets []string
+}
+
+func newPacketWriter() *packetWriter {
+	return &packetWriter{lock: &sync.Mutex{}}
+}
+
+func (w *packetWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.packets = append(w.packets, string(b))
+	return len(b), nil
+}
+
+func (w *packetWriter) written() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string(nil), w.packets...)
+}
+
+func TestStatsdSenderFormat(t *testing.T) {
+	var w = newPacketWriter()
+	var s = NewStatsdSender(w, 1024, 0, StatsdOptionPrefix("prefix."))
+	s.Gauge("gauge", 1, "a:b", "c:d")
+	s.Count("count", 2)
+	s.Histogram("histogram", 3.5, "a:b")
+	s.Timing("timing", 1500*time.Microsecond)
+	assert.Empty(t, w.written())
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.Equal(t, []string{
+		"prefix.gauge:1.000000|g|#a:b,c:d\n" +
+			"prefix.count:2.000000|c\n" +
+			"prefix.histogram:3.500000|h|#a:b\n" +
+			"prefix.timing:1.500000|ms\n",
+	}, w.written())
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.Len(t, w.written(), 1)
+}
+
+func TestStatsdSenderMaxPacketSize(t *testing.T) {
+	var w = newPacketWriter()
+	var line = "count:1.000000|c\n"
+	var s = NewStatsdSender(w, len(line)*2+1, 0)
+	s.Count("count", 1)
+	s.Count("count", 1)
+	assert.Empty(t, w.written())
+	s.Count("count", 1)
+	assert.Equal(t, []string{line + line}, w.written())
+
+	s = NewStatsdSender(w, len(line)*2, 0)
+	s.Count("count", 1)
+	s.Count("count", 1)
+	assert.Equal(t, []string{line + line, line + line}, w.written())
+}
+
+func TestStatsdSenderSynchronous(t *testing.T) {
+	var w = newPacketWriter()
+	var s = NewStatsdSender(w, 1024, time.Hour, StatsdOptionSynchronous())
+	assert.False(t, s.started)
+	s.Count("count", 1)
+	s.Count("count", 2)
+	assert.Equal(t, []string{"count:1.000000|c\n", "count:2.000000|c\n"}, w.written())
+	assert.NoError(t, s.Close(context.Background()))
+}
+
+func TestStatsdSenderInterval(t *testing.T) {
+	var w = newPacketWriter()
+	var s = NewStatsdSender(w, 1024, time.Millisecond)
+	defer s.Close(context.Background())
+	s.Count("count", 1)
+	var deadline = time.Now().Add(time.Second)
+	for len(w.written()) < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, []string{"count:1.000000|c\n"}, w.written())
+}
+
+func TestStatsdSenderClose(t *testing.T) {
+	var w = newPacketWriter()
+	var s = NewStatsdSender(w, 1024, time.Hour)
+	s.Count("count", 1)
+	assert.NoError(t, s.Close(context.Background()))
+	assert.Equal(t, []string{"count:1.000000|c\n"}, w.written())
+	s.Count("count", 1)
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.NoError(t, s.Close(context.Background()))
+	assert.Len(t, w.written(), 1)
+}
+
+func TestStatsdSenderFlushContext(t *testing.T) {
+	var w = &bytes.Buffer{}
+	var s = NewStatsdSender(w, 1024, 0)
+	s.Count("count", 1)
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, s.Flush(ctx))
+	assert.Empty(t, w.String())
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.True(t, strings.HasPrefix(w.String(), "count:"))
+}
+
+func TestStatsdNetwork(t *testing.T) {
+	var cases = map[string][2]string{
+		"localhost:8125":                         {"udp", "localhost:8125"},
+		"udp://localhost:8125":                   {"udp", "localhost:8125"},
+		"unix:///var/run/datadog/dsd.socket":     {"unixgram", "/var/run/datadog/dsd.socket"},
+		"unixgram:///var/run/datadog/dsd.socket": {"unixgram", "/var/run/datadog/dsd.socket"},
+	}
+	for address, expected := range cases {
+		var network, addr = statsdNetwork(address)
+		assert.Equal(t, expected, [2]string{network, addr}, address)
+	}
+	assert.Equal(t, udpMaxPacketSize, statsdPacketSize("udp", 0))
+	assert.Equal(t, unixMaxPacketSize, statsdPacketSize("unixgram", -1))
+	assert.Equal(t, 512, statsdPacketSize("unixgram", 512))
+}
+
+func listenUnixgram(t *testing.T) (*net.UnixConn, string) {
+	var path = filepath.Join(t.TempDir(), "dsd.socket")
+	var conn, e = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if e != nil {
+		t.Skipf("unix datagram sockets are not available: %s", e.Error())
+	}
+	return conn, path
+}
+
+func readPacket(t *testing.T, conn *net.UnixConn) string {
+	var buf = make([]byte, unixMaxPacketSize)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	var n, e = conn.Read(buf)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	return string(buf[:n])
+}
+
+func TestMiddlewareOptionUDPSenderUnixSocket(t *testing.T) {
+	var listener, path = listenUnixgram(t)
+	defer listener.Close()
+
+	var result, _, closer, e = NewMiddlewareCloser(MiddlewareOptionUDPSender("unix://"+path, 0, time.Hour, "prefix."))
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(fixtureHandler{}).(*Middleware)
+	assert.Equal(t, unixMaxPacketSize, m.statsd[0].maxPacketSize)
+	assert.Equal(t, unixWriteTimeout, m.statsd[0].writeTimeout)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.NoError(t, closer.Close(context.Background()))
+	assert.True(t, strings.HasPrefix(readPacket(t, listener), "prefix.service_time:"))
+}
+
+func TestMiddlewareOptionUDPGlobalRollupSenderUnixSocket(t *testing.T) {
+	var listener, path = listenUnixgram(t)
+	defer listener.Close()
+
+	var result, _, closer, e = NewMiddlewareCloser(MiddlewareOptionUDPGlobalRollupSender("unixgram://"+path, 0, time.Hour, "", []string{"region"}))
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(fixtureHandler{}).(*Middleware)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.NoError(t, closer.Close(context.Background()))
+	var packet = readPacket(t, listener)
+	assert.True(t, strings.HasPrefix(packet, "service_time:"))
+	assert.Contains(t, packet, "region:global")
+}
@@ -0,0 +1,451 @@
+package httpstats
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// streamBatchSize is the number of buffered bytes that triggers a flush
+	// before the flush interval elapses and the size of each write.
+	streamBatchSize = 8192
+	// streamWriteTimeout bounds how long a background flush may block on a
+	// connection.
+	streamWriteTimeout = time.Second
+)
+
+var errStatsdStreamBackoff = errors.New("statsd stream sender is waiting to reconnect")
+
+// statsdStreamNetwork returns the network and address to dial for the address
+// of a statsd agent that accepts streams. Addresses using the unix:// scheme
+// are dialed as unix stream sockets and all others, including those using the
+// tcp:// scheme, are dialed over TCP.
+func statsdStreamNetwork(address string) (string, string) {
+	if strings.HasPrefix(address, "unix://") {
+		return "unix", strings.TrimPrefix(address, "unix://")
+	}
+	return "tcp", strings.TrimPrefix(address, "tcp://")
+}
+
+// StatsdStreamSender is an xstats.Sender that emits newline delimited metrics
+// using the datadog extensions to the statsd line protocol over a TCP or unix
+// stream connection. Metrics are buffered in memory and written on each flush
+// interval or once enough have been buffered. If the connection fails then
+// the sender reconnects with an exponential backoff and buffers metrics up to
+// a bound, after which the oldest metrics are dropped. The number of metrics
+// sent and dropped, and the number of reconnects, are emitted through the
+// sender itself as the statsd_sender_metrics_sent,
+// statsd_sender_metrics_dropped, and statsd_sender_reconnects counters.
+type StatsdStreamSender struct {
+	network        string
+	address        string
+	interval       time.Duration
+	prefix         string
+	maxBuffer      int
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	sentName       string
+	droppedName    string
+	reconnectsName string
+	dial           func(ctx context.Context, network string, address string) (net.Conn, error)
+
+	lock   *sync.Mutex
+	queue  []string
+	queued int
+	closed bool
+
+	sent       int64
+	dropped    int64
+	reconnects int64
+	reported   [3]int64
+
+	writeLock   *sync.Mutex
+	conn        net.Conn
+	connected   bool
+	failures    int
+	nextAttempt time.Time
+
+	trigger  chan struct{}
+	started  bool
+	finished bool
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce *sync.Once
+}
+
+// StatsdStreamOption is used to configure a StatsdStreamSender.
+type StatsdStreamOption func(*StatsdStreamSender) *StatsdStreamSender
+
+// StatsdStreamOptionPrefix prepends the prefix to the name of every metric.
+func StatsdStreamOptionPrefix(prefix string) StatsdStreamOption {
+	return func(s *StatsdStreamSender) *StatsdStreamSender {
+		s.prefix = prefix
+		return s
+	}
+}
+
+// StatsdStreamOptionMaxBuffer sets the number of bytes of metrics that may be
+// buffered while they cannot be sent. The oldest metrics are dropped once the
+// bound is reached. The default value is 1MiB. Values less than or equal to
+// zero are ignored.
+func StatsdStreamOptionMaxBuffer(maxBytes int) StatsdStreamOption {
+	return func(s *StatsdStreamSender) *StatsdStreamSender {
+		if maxBytes > 0 {
+			s.maxBuffer = maxBytes
+		}
+		return s
+	}
+}
+
+// StatsdStreamOptionBackoff sets the delay before the first reconnect attempt
+// and the maximum delay between attempts. The delay doubles after each failed
+// attempt. The default values are 100ms and 10s. Values less than or equal to
+// zero are ignored.
+func StatsdStreamOptionBackoff(minBackoff time.Duration, maxBackoff time.Duration) StatsdStreamOption {
+	return func(s *StatsdStreamSender) *StatsdStreamSender {
+		if minBackoff > 0 && maxBackoff >= minBackoff {
+			s.minBackoff = minBackoff
+			s.maxBackoff = maxBackoff
+		}
+		return s
+	}
+}
+
+// StatsdStreamOptionStatNames sets the metric names used to report the
+// number of metrics sent and dropped and the number of reconnects. The
+// default values are statsd_sender_metrics_sent,
+// statsd_sender_metrics_dropped, and statsd_sender_reconnects.
+func StatsdStreamOptionStatNames(sentName string, droppedName string, reconnectsName string) StatsdStreamOption {
+	return func(s *StatsdStreamSender) *StatsdStreamSender {
+		s.sentName = sentName
+		s.droppedName = droppedName
+		s.reconnectsName = reconnectsName
+		return s
+	}
+}
+
+// NewStatsdStreamSender creates a StatsdStreamSender for the given address.
+// The address may be a host and port, a tcp:// address, or the unix://
+// address of a unix stream socket. The connection is established on the
+// first flush so the agent need not be available when the sender is created.
+func NewStatsdStreamSender(address string, flushInterval time.Duration, options ...StatsdStreamOption) *StatsdStreamSender {
+	var s = newStatsdStreamSender(address, flushInterval, options...)
+	s.start()
+	return s
+}
+
+// newStatsdStreamSender creates a sender without starting its background
+// flushing so that the Middleware only starts it once every option applied.
+func newStatsdStreamSender(address string, flushInterval time.Duration, options ...StatsdStreamOption) *StatsdStreamSender {
+	var network, addr = statsdStreamNetwork(address)
+	var s = &StatsdStreamSender{
+		network:        network,
+		address:        addr,
+		interval:       flushInterval,
+		maxBuffer:      1 << 20,
+		minBackoff:     100 * time.Millisecond,
+		maxBackoff:     10 * time.Second,
+		sentName:       "statsd_sender_metrics_sent",
+		droppedName:    "statsd_sender_metrics_dropped",
+		reconnectsName: "statsd_sender_reconnects",
+		dial:           (&net.Dialer{Timeout: streamWriteTimeout}).DialContext,
+		lock:           &sync.Mutex{},
+		writeLock:      &sync.Mutex{},
+		trigger:        make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+		stopOnce:       &sync.Once{},
+	}
+	for _, option := range options {
+		s = option(s)
+	}
+	return s
+}
+
+func (s *StatsdStreamSender) start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started || s.closed {
+		return
+	}
+	s.started = true
+	go s.run()
+}
+
+func (s *StatsdStreamSender) run() {
+	defer close(s.done)
+	var tick <-chan time.Time
+	if s.interval > 0 {
+		var ticker = time.NewTicker(s.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-s.trigger:
+		case <-s.stop:
+			return
+		}
+		var ctx, cancel = context.WithTimeout(context.Background(), streamWriteTimeout)
+		s.writeLock.Lock()
+		var e = s.flush(ctx, false)
+		s.writeLock.Unlock()
+		cancel()
+		if e != nil && e != errStatsdStreamBackoff {
+			logStatsdError(e)
+		}
+	}
+}
+
+func (s *StatsdStreamSender) send(stat string, value float64, kind string, tags []string) {
+	s.sendLines(statsdLine(s.prefix, stat, value, kind, tags))
+}
+
+func (s *StatsdStreamSender) sendValues(stat string, values []float64, kind string, tags []string) {
+	s.sendLines(statsdValueLines(s.prefix, stat, values, kind, tags, streamBatchSize)...)
+}
+
+func (s *StatsdStreamSender) sendLines(lines ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.enqueue(false, lines...)
+	if s.queued >= streamBatchSize {
+		select {
+		case s.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// enqueue adds lines to the back, or the front, of the queue and then drops
+// the oldest lines until the queue fits within the bound. It must be called
+// with the lock held.
+func (s *StatsdStreamSender) enqueue(front bool, lines ...string) {
+	if front {
+		s.queue = append(append(make([]string, 0, len(lines)+len(s.queue)), lines...), s.queue...)
+	} else {
+		s.queue = append(s.queue, lines...)
+	}
+	for _, line := range lines {
+		s.queued = s.queued + len(line)
+	}
+	for s.queued > s.maxBuffer && len(s.queue) > 0 {
+		s.queued = s.queued - len(s.queue[0])
+		s.queue = s.queue[1:]
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// selfCounts returns the number of metrics sent and dropped and the number
+// of reconnects.
+func (s *StatsdStreamSender) selfCounts() [3]int64 {
+	return [3]int64{atomic.LoadInt64(&s.sent), atomic.LoadInt64(&s.dropped), atomic.LoadInt64(&s.reconnects)}
+}
+
+// selfLines returns the change in the sender's own counts since the previous
+// report. It must be called with the write lock held.
+func (s *StatsdStreamSender) selfLines(counts [3]int64) []string {
+	var names = [3]string{s.sentName, s.droppedName, s.reconnectsName}
+	var lines []string
+	for offset := range counts {
+		if delta := counts[offset] - s.reported[offset]; delta > 0 {
+			lines = append(lines, statsdLine(s.prefix, names[offset], float64(delta), "c", nil))
+		}
+	}
+	return lines
+}
+
+// backoff must be called with the write lock held.
+func (s *StatsdStreamSender) backoff() {
+	s.failures = s.failures + 1
+	var delay = s.minBackoff
+	for attempt := 1; attempt < s.failures && delay < s.maxBackoff; attempt = attempt + 1 {
+		delay = delay * 2
+	}
+	if delay > s.maxBackoff {
+		delay = s.maxBackoff
+	}
+	s.nextAttempt = time.Now().Add(delay)
+}
+
+// connect must be called with the write lock held.
+func (s *StatsdStreamSender) connect(ctx context.Context, force bool) error {
+	if s.conn != nil {
+		return nil
+	}
+	if !force && time.Now().Before(s.nextAttempt) {
+		return errStatsdStreamBackoff
+	}
+	var conn, e = s.dial(ctx, s.network, s.address)
+	if e != nil {
+		s.backoff()
+		return e
+	}
+	if s.connected {
+		atomic.AddInt64(&s.reconnects, 1)
+	}
+	s.connected = true
+	s.failures = 0
+	s.conn = conn
+	return nil
+}
+
+// flush writes the queued lines. The sender's own counts are reported ahead
+// of the queued lines once connected so that they never displace buffered
+// metrics. Queued lines that could not be written are returned to the front
+// of the queue. It must be called with the write lock held.
+func (s *StatsdStreamSender) flush(ctx context.Context, force bool) error {
+	s.lock.Lock()
+	var lines = s.queue
+	s.queue = nil
+	s.queued = 0
+	s.lock.Unlock()
+	if len(lines) < 1 && s.selfCounts() == s.reported {
+		return nil
+	}
+	var e = s.connect(ctx, force)
+	if e == nil {
+		var counts = s.selfCounts()
+		var self = s.selfLines(counts)
+		// A context without a deadline clears any previous deadline.
+		var deadline, _ = ctx.Deadline()
+		_ = s.conn.SetWriteDeadline(deadline)
+		var offset int
+		offset, e = s.write(append(self, lines...))
+		if offset >= len(self) {
+			s.reported = counts
+			offset = offset - len(self)
+			atomic.AddInt64(&s.sent, int64(offset))
+			lines = lines[offset:]
+		}
+	}
+	if len(lines) > 0 {
+		s.lock.Lock()
+		s.enqueue(true, lines...)
+		s.lock.Unlock()
+	}
+	return e
+}
+
+// write sends the lines in batches and returns the number of lines that
+// were written in full. The connection is closed if a write fails. A line
+// that was only partly written is not counted so that it is sent again, in
+// full, on the next connection.
+func (s *StatsdStreamSender) write(lines []string) (int, error) {
+	var buf = &bytes.Buffer{}
+	var offset = 0
+	for offset < len(lines) {
+		buf.Reset()
+		var end = offset
+		for end < len(lines) && (end == offset || buf.Len()+len(lines[end]) <= streamBatchSize) {
+			buf.WriteString(lines[end])
+			end = end + 1
+		}
+		if n, e := s.conn.Write(buf.Bytes()); e != nil {
+			for offset < end && n >= len(lines[offset]) {
+				n = n - len(lines[offset])
+				offset = offset + 1
+			}
+			_ = s.conn.Close()
+			s.conn = nil
+			s.backoff()
+			return offset, e
+		}
+		offset = end
+	}
+	return offset, nil
+}
+
+// Gauge implements the xstats.Sender interface.
+func (s *StatsdStreamSender) Gauge(stat string, value float64, tags ...string) {
+	s.send(stat, value, "g", tags)
+}
+
+// Count implements the xstats.Sender interface.
+func (s *StatsdStreamSender) Count(stat string, count float64, tags ...string) {
+	s.send(stat, count, "c", tags)
+}
+
+// Histogram implements the xstats.Sender interface.
+func (s *StatsdStreamSender) Histogram(stat string, value float64, tags ...string) {
+	s.send(stat, value, "h", tags)
+}
+
+// Timing implements the xstats.Sender interface.
+func (s *StatsdStreamSender) Timing(stat string, duration time.Duration, tags ...string) {
+	s.send(stat, duration.Seconds()*1000, "ms", tags)
+}
+
+// Distribution implements the DistributionSender interface.
+func (s *StatsdStreamSender) Distribution(stat string, value float64, tags ...string) {
+	s.send(stat, value, "d", tags)
+}
+
+// Flush writes any buffered metrics, connecting to the agent if needed
+// regardless of the reconnect backoff.
+func (s *StatsdStreamSender) Flush(ctx context.Context) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.flush(ctx, true)
+}
+
+// Close stops the background flushing, writes any buffered metrics, and
+// closes the connection. Metrics recorded after Close are dropped. If Close
+// fails, such as when the context expires before the buffered metrics are
+// written, then it may be called again to retry. Calling Close after it has
+// succeeded has no effect.
+func (s *StatsdStreamSender) Close(ctx context.Context) error {
+	s.lock.Lock()
+	s.closed = true
+	var started = s.started
+	s.lock.Unlock()
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	if started {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.finished {
+		return nil
+	}
+	if e := s.flush(ctx, true); e != nil {
+		return e
+	}
+	s.finished = true
+	if s.conn != nil {
+		var e = s.conn.Close()
+		s.conn = nil
+		return e
+	}
+	return nil
+}
+
+// MiddlewareOptionStatsdStreamSender enables datadog style statsd emissions
+// over a TCP or unix stream connection using a StatsdStreamSender. The
+// sender is flushed and closed by the FlushCloser returned from
+// NewMiddlewareCloser.
+func MiddlewareOptionStatsdStreamSender(address string, flushInterval time.Duration, options ...StatsdStreamOption) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		var sender = newStatsdStreamSender(address, flushInterval, options...)
+		m.statsdStreams = append(m.statsdStreams, sender)
+		m.senders = append(m.senders, sender)
+		m.flushers = append(m.flushers, sender)
+		return m, nil
+	}
+}
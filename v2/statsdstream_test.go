@@ -0,0 +1,233 @@
+package httpstats
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// streamConn records writes and fails them once broken. If partial is set
+// then the next write only accepts that many bytes before breaking.
+type streamConn struct {
+	recordingConn
+	broken  bool
+	partial int
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	if c.partial > 0 {
+		var n = c.partial
+		c.partial = 0
+		c.broken = true
+		_, _ = c.recordingConn.Write(b[:n])
+		return n, errors.New("broken pipe")
+	}
+	if c.broken {
+		return 0, errors.New("broken pipe")
+	}
+	return c.recordingConn.Write(b)
+}
+
+// streamDialer hands out a new streamConn for each dial unless down is set.
+type streamDialer struct {
+	down  bool
+	conns []*streamConn
+}
+
+func (d *streamDialer) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	if d.down {
+		return nil, errors.New("connection refused")
+	}
+	var conn = &streamConn{recordingConn: recordingConn{packetWriter: newPacketWriter()}}
+	d.conns = append(d.conns, conn)
+	return conn, nil
+}
+
+func (d *streamDialer) option() StatsdStreamOption {
+	return func(s *StatsdStreamSender) *StatsdStreamSender {
+		s.dial = d.dial
+		return s
+	}
+}
+
+func TestStatsdStreamNetwork(t *testing.T) {
+	var network, address = statsdStreamNetwork("localhost:8125")
+	assert.Equal(t, [2]string{"tcp", "localhost:8125"}, [2]string{network, address})
+	network, address = statsdStreamNetwork("tcp://localhost:8125")
+	assert.Equal(t, [2]string{"tcp", "localhost:8125"}, [2]string{network, address})
+	network, address = statsdStreamNetwork("unix:///var/run/datadog/dsd.socket")
+	assert.Equal(t, [2]string{"unix", "/var/run/datadog/dsd.socket"}, [2]string{network, address})
+}
+
+func TestStatsdStreamSenderDropOldest(t *testing.T) {
+	var dialer = &streamDialer{down: true}
+	var line = "count:1.000000|c\n"
+	var s = NewStatsdStreamSender("localhost:8125", 0, dialer.option(), StatsdStreamOptionMaxBuffer(len(line)*3))
+	defer s.Close(context.Background())
+	for x := 1; x <= 5; x = x + 1 {
+		s.Count("count", float64(x))
+	}
+	assert.Equal(t, int64(2), s.dropped)
+	assert.Error(t, s.Flush(context.Background()))
+	assert.Equal(t, int64(2), s.dropped)
+
+	dialer.down = false
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.Equal(t, []string{
+		"statsd_sender_metrics_dropped:2.000000|c\ncount:3.000000|c\ncount:4.000000|c\ncount:5.000000|c\n",
+		"statsd_sender_metrics_sent:3.000000|c\n",
+	}, dialer.conns[0].written())
+}
+
+func TestStatsdStreamSenderReconnect(t *testing.T) {
+	var dialer = &streamDialer{}
+	var s = NewStatsdStreamSender("localhost:8125", 0, dialer.option(), StatsdStreamOptionBackoff(time.Hour, time.Hour), StatsdStreamOptionStatNames("sent", "dropped", "reconnects"))
+	defer s.Close(context.Background())
+	s.Count("count", 1)
+	assert.NoError(t, s.Flush(context.Background()))
+
+	dialer.conns[0].broken = true
+	s.Count("count", 2)
+	assert.Error(t, s.Flush(context.Background()))
+	assert.True(t, dialer.conns[0].closed)
+
+	s.writeLock.Lock()
+	assert.Equal(t, errStatsdStreamBackoff, s.flush(context.Background(), false))
+	s.writeLock.Unlock()
+	assert.Len(t, dialer.conns, 1)
+
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.Len(t, dialer.conns, 2)
+	assert.Equal(t, []string{"sent:1.000000|c\nreconnects:1.000000|c\ncount:2.000000|c\n"}, dialer.conns[1].written())
+}
+
+func TestStatsdStreamSenderPartialWrite(t *testing.T) {
+	var dialer = &streamDialer{}
+	var s = NewStatsdStreamSender("localhost:8125", 0, dialer.option(), StatsdStreamOptionStatNames("sent", "dropped", "reconnects"))
+	defer s.Close(context.Background())
+	s.Count("count", 0)
+	assert.NoError(t, s.Flush(context.Background()))
+
+	var self = "sent:1.000000|c\n"
+	var line = "count:1.000000|c\n"
+	s.Count("count", 1)
+	s.Count("count", 2)
+	s.Count("count", 3)
+	dialer.conns[0].partial = len(self) + len(line) + 3
+	assert.Error(t, s.Flush(context.Background()))
+
+	// The first line is not sent again and the partly written line is sent
+	// again in full.
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.Equal(t, []string{"count:0.000000|c\n", self + line + "cou"}, dialer.conns[0].written())
+	assert.Equal(t, []string{"sent:1.000000|c\nreconnects:1.000000|c\ncount:2.000000|c\ncount:3.000000|c\n"}, dialer.conns[1].written())
+}
+
+func TestStatsdStreamSenderBackoff(t *testing.T) {
+	var s = &StatsdStreamSender{minBackoff: time.Second, maxBackoff: 5 * time.Second}
+	var expected = []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for _, delay := range expected {
+		var before = time.Now()
+		s.backoff()
+		assert.InDelta(t, float64(delay), float64(s.nextAttempt.Sub(before)), float64(100*time.Millisecond))
+	}
+}
+
+func TestStatsdStreamSenderClose(t *testing.T) {
+	var dialer = &streamDialer{}
+	var s = NewStatsdStreamSender("localhost:8125", time.Hour, dialer.option())
+	s.Count("count", 1)
+	assert.NoError(t, s.Close(context.Background()))
+	assert.Equal(t, []string{"count:1.000000|c\n"}, dialer.conns[0].written())
+	assert.True(t, dialer.conns[0].closed)
+	s.Count("count", 2)
+	assert.NoError(t, s.Close(context.Background()))
+	assert.Len(t, dialer.conns[0].written(), 1)
+}
+
+func TestStatsdStreamSenderCloseRetry(t *testing.T) {
+	var dialer = &streamDialer{}
+	var s = NewStatsdStreamSender("localhost:8125", 0, dialer.option())
+	s.Count("count", 1)
+	// The background flush is held on the write lock so that it cannot stop
+	// before the context of the first Close expires.
+	s.writeLock.Lock()
+	s.trigger <- struct{}{}
+	time.Sleep(10 * time.Millisecond)
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, s.Close(ctx))
+	s.writeLock.Unlock()
+
+	assert.NoError(t, s.Close(context.Background()))
+	assert.NoError(t, s.Close(context.Background()))
+	assert.Equal(t, []string{"count:1.000000|c\n", "statsd_sender_metrics_sent:1.000000|c\n"}, dialer.conns[0].written())
+	assert.True(t, dialer.conns[0].closed)
+}
+
+func readStreamLine(t *testing.T, listener net.Listener) string {
+	var conn, e = listener.Accept()
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	var line, err = bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return line
+}
+
+func TestMiddlewareOptionStatsdStreamSender(t *testing.T) {
+	var tcp, e = net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer tcp.Close()
+	var unix net.Listener
+	unix, e = net.Listen("unix", filepath.Join(t.TempDir(), "dsd.socket"))
+	if e != nil {
+		t.Skipf("unix stream sockets are not available: %s", e.Error())
+	}
+	defer unix.Close()
+
+	var result, _, closer, err = NewMiddlewareCloser(
+		MiddlewareOptionStatsdStreamSender("tcp://"+tcp.Addr().String(), time.Hour),
+		MiddlewareOptionStatsdStreamSender("unix://"+unix.Addr().String(), time.Hour, StatsdStreamOptionPrefix("prefix.")),
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var m = result(fixtureHandler{}).(*Middleware)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.NoError(t, closer.Close(context.Background()))
+	assert.True(t, strings.HasPrefix(readStreamLine(t, tcp), "service_time:"))
+	assert.True(t, strings.HasPrefix(readStreamLine(t, unix), "prefix.service_time:"))
+}
+
+func TestMiddlewareOptionStatsdStreamSenderError(t *testing.T) {
+	var sender *StatsdStreamSender
+	var _, _, _, e = NewMiddlewareCloser(
+		MiddlewareOptionStatsdStreamSender("localhost:8125", time.Hour),
+		func(m *Middleware) (*Middleware, error) {
+			sender = m.statsdStreams[0]
+			return nil, errors.New("invalid option")
+		},
+	)
+	assert.Error(t, e)
+	// The sender of a Middleware that failed to build is never started.
+	assert.False(t, sender.started)
+	assert.NoError(t, sender.Close(context.Background()))
+}
@@ -0,0 +1,119 @@
+package httpstats
+
+import (
+	"context"
+	"net/http"
+)
+
+const (
+	redirectName    = "redirect"
+	clientErrorName = "client_error"
+	serverErrorName = "server_error"
+)
+
+// StatusClassifier functions determine the value of the status tag for a
+// request. They are given the request, the response status code, and the
+// error of the request context, if any. For client requests that fail
+// without a response the status code is one derived from the error, such as
+// 502 for connection failures or 504 for timeouts.
+type StatusClassifier func(r *http.Request, statusCode int, ctxErr error) string
+
+// StatusClassifierDefault reports ok for 2xx responses and error for all
+// other responses. Requests whose context deadline was exceeded are reported
+// as timeout and requests whose context was cancelled are reported as
+// cancelled. This is the classifier used if no other is configured.
+func StatusClassifierDefault(r *http.Request, statusCode int, ctxErr error) string {
+	if ctxErr != nil {
+		return contextStatus(ctxErr)
+	}
+	if statusCode >= 200 && statusCode < 300 {
+		return "ok"
+	}
+	return errorName
+}
+
+// StatusClassifierClass reports the class of the response status code. 3xx
+// responses are reported as redirect, 4xx as client_error, 5xx as
+// server_error, and all others as ok. Context errors are reported in the same
+// way as StatusClassifierDefault.
+func StatusClassifierClass(r *http.Request, statusCode int, ctxErr error) string {
+	if ctxErr != nil {
+		return contextStatus(ctxErr)
+	}
+	switch {
+	case statusCode >= 500:
+		return serverErrorName
+	case statusCode >= 400:
+		return clientErrorName
+	case statusCode >= 300:
+		return redirectName
+	}
+	return "ok"
+}
+
+func contextStatus(ctxErr error) string {
+	if ctxErr == context.DeadlineExceeded {
+		return "timeout"
+	}
+	return "cancelled"
+}
+
+// StatusOverride identifies status codes that are expected for a route and
+// the status that should be reported for them. The Status defaults to ok if
+// empty.
+type StatusOverride struct {
+	Route       string
+	StatusCodes []int
+	Status      string
+}
+
+// StatusClassifierWithOverrides wraps a classifier such that the status codes
+// given in each override are reported with the override status when the
+// extractor resolves the request to the override route. This can be used to
+// report, for example, 404 responses from a lookup endpoint as ok. Requests
+// with a context error are always passed to the wrapped classifier.
+func StatusClassifierWithOverrides(classifier StatusClassifier, extractor RouteExtractor, overrides ...StatusOverride) StatusClassifier {
+	var lookup = make(map[string]map[int]string, len(overrides))
+	for _, override := range overrides {
+		var status = override.Status
+		if status == "" {
+			status = "ok"
+		}
+		var codes, ok = lookup[override.Route]
+		if !ok {
+			codes = make(map[int]string, len(override.StatusCodes))
+			lookup[override.Route] = codes
+		}
+		for _, code := range override.StatusCodes {
+			codes[code] = status
+		}
+	}
+	return func(r *http.Request, statusCode int, ctxErr error) string {
+		if ctxErr == nil {
+			if route, ok := extractor(r); ok {
+				if status, ok := lookup[route][statusCode]; ok {
+					return status
+				}
+			}
+		}
+		return classifier(r, statusCode, ctxErr)
+	}
+}
+
+// MiddlewareOptionStatusClassifier sets the classifier used to determine the
+// server_status tag. The default is StatusClassifierDefault.
+func MiddlewareOptionStatusClassifier(classifier StatusClassifier) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		m.statusClassifier = classifier
+		return m, nil
+	}
+}
+
+// TransportOptionStatusClassifier sets the classifier used to determine the
+// status tag. The default is StatusClassifierDefault.
+func TransportOptionStatusClassifier(classifier StatusClassifier) TransportOption {
+	return func(m *Transport) *Transport {
+		m.statusClassifier = classifier
+		return m
+	}
+}
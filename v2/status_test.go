@@ -0,0 +1,119 @@
+package httpstats
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/xstats"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func statusTransport(statusCode int) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: statusCode,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(``)),
+		}, nil
+	})
+}
+
+func TestStatusClassifierDefault(t *testing.T) {
+	var cases = map[int]string{
+		http.StatusOK:                  "ok",
+		http.StatusNoContent:           "ok",
+		http.StatusNotModified:         errorName,
+		http.StatusNotFound:            errorName,
+		http.StatusInternalServerError: errorName,
+	}
+	for code, expected := range cases {
+		assert.Equal(t, expected, StatusClassifierDefault(nil, code, nil), code)
+	}
+	assert.Equal(t, "timeout", StatusClassifierDefault(nil, http.StatusOK, context.DeadlineExceeded))
+	assert.Equal(t, "cancelled", StatusClassifierDefault(nil, http.StatusOK, context.Canceled))
+}
+
+func TestStatusClassifierClass(t *testing.T) {
+	var cases = map[int]string{
+		http.StatusOK:                  "ok",
+		http.StatusNotModified:         "redirect",
+		http.StatusFound:               "redirect",
+		http.StatusNotFound:            "client_error",
+		http.StatusTooManyRequests:     "client_error",
+		http.StatusInternalServerError: "server_error",
+		http.StatusBadGateway:          "server_error",
+	}
+	for code, expected := range cases {
+		assert.Equal(t, expected, StatusClassifierClass(nil, code, nil), code)
+	}
+	assert.Equal(t, "timeout", StatusClassifierClass(nil, http.StatusOK, context.DeadlineExceeded))
+	assert.Equal(t, "cancelled", StatusClassifierClass(nil, http.StatusOK, context.Canceled))
+}
+
+func TestStatusClassifierWithOverrides(t *testing.T) {
+	var extractor = RouteExtractor(func(r *http.Request) (string, bool) {
+		return r.URL.Path, r.URL.Path != "/unknown"
+	})
+	var classifier = StatusClassifierWithOverrides(
+		StatusClassifierClass,
+		extractor,
+		StatusOverride{Route: "/lookup", StatusCodes: []int{http.StatusNotFound}},
+		StatusOverride{Route: "/cache", StatusCodes: []int{http.StatusNotModified}, Status: "cached"},
+	)
+	var lookup = httptest.NewRequest(http.MethodGet, "/lookup", nil)
+	assert.Equal(t, "ok", classifier(lookup, http.StatusNotFound, nil))
+	assert.Equal(t, "client_error", classifier(lookup, http.StatusBadRequest, nil))
+	assert.Equal(t, "timeout", classifier(lookup, http.StatusNotFound, context.DeadlineExceeded))
+	assert.Equal(t, "cached", classifier(httptest.NewRequest(http.MethodGet, "/cache", nil), http.StatusNotModified, nil))
+	assert.Equal(t, "client_error", classifier(httptest.NewRequest(http.MethodGet, "/other", nil), http.StatusNotFound, nil))
+	assert.Equal(t, "client_error", classifier(httptest.NewRequest(http.MethodGet, "/unknown", nil), http.StatusNotFound, nil))
+}
+
+func TestMiddlewareOptionStatusClassifier(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionStatusClassifier(StatusClassifierClass),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(http.NotFoundHandler()).(*Middleware)
+
+	var tags = []interface{}{"server_method:GET", "server_status_code:404", "server_status:client_error"}
+	sender.EXPECT().Timing(m.requestTime, gomock.Any(), tags...)
+	sender.EXPECT().Timing(m.timeToHeaders, gomock.Any(), tags...)
+	sender.EXPECT().Timing(m.timeToFirstByte, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesIn, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesOut, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesTotal, gomock.Any(), tags...)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestTransportOptionStatusClassifier(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var stat = xstats.New(sender)
+	var r = NewTransport(TransportOptionStatusClassifier(StatusClassifierClass))(statusTransport(http.StatusServiceUnavailable))
+
+	sender.EXPECT().Timing("client_request_time", gomock.Any(), "method:GET", "status_code:503", "status:server_error")
+	sender.EXPECT().Histogram("client_request_bytes_received", gomock.Any())
+	var req = httptest.NewRequest(http.MethodGet, "/", nil).WithContext(xstats.NewContext(context.Background(), stat))
+	var _, e = r.RoundTrip(req)
+	assert.NoError(t, e)
+}
@@ -0,0 +1,337 @@
+package httpstats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xstats"
+)
+
+const (
+	responseTypeTagName  = "server_response_type"
+	responseTypeStandard = "standard"
+	responseTypeStream   = "streaming"
+	responseTypeUpgraded = "upgraded"
+	responseTypeHijacked = "hijacked"
+)
+
+// streaming holds the configuration of long lived response tracking along
+// with the trackers of the hijacked connections that are still open.
+type streaming struct {
+	interval         time.Duration
+	bytesIn          string
+	bytesOut         string
+	hijackedTime     string
+	hijackedBytesIn  string
+	hijackedBytesOut string
+	lock             *sync.Mutex
+	closed           bool
+	hijacked         map[*streamTracker]bool
+}
+
+// track records a tracker that reports on a hijacked connection so that it
+// can be stopped when the middleware is closed. It returns false if the
+// middleware is already closed.
+func (s *streaming) track(t *streamTracker) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.hijacked[t] = true
+	return true
+}
+
+func (s *streaming) untrack(t *streamTracker) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.hijacked, t)
+}
+
+// close stops reporting on the hijacked connections that are still open.
+func (s *streaming) close() {
+	s.lock.Lock()
+	var trackers = s.hijacked
+	s.hijacked = make(map[*streamTracker]bool)
+	s.closed = true
+	s.lock.Unlock()
+	for t := range trackers {
+		t.halt()
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	count *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	var n, e = r.Reader.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, e
+}
+
+// hijackedConn counts the bytes sent and received on a hijacked connection
+// and reports the lifetime of the connection once it is closed.
+type hijackedConn struct {
+	net.Conn
+	read    *int64
+	written *int64
+	start   time.Time
+	once    *sync.Once
+	closed  func()
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	var n, e = c.Conn.Read(p)
+	atomic.AddInt64(c.read, int64(n))
+	return n, e
+}
+
+func (c *hijackedConn) Write(p []byte) (int, error) {
+	var n, e = c.Conn.Write(p)
+	atomic.AddInt64(c.written, int64(n))
+	return n, e
+}
+
+func (c *hijackedConn) Close() error {
+	var e = c.Conn.Close()
+	c.once.Do(c.closed)
+	return e
+}
+
+// streamTracker follows a single request and, once the response is detected
+// as long lived, periodically emits the bytes transferred.
+type streamTracker struct {
+	config   *streaming
+	stat     xstats.XStater
+	r        *http.Request
+	wrapper  writerProxy
+	body     *recordingReader
+	flushed  int32
+	lock     *sync.Mutex
+	hijacked *hijackedConn
+	once     *sync.Once
+	stopOnce *sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+	lastIn   int64
+	lastOut  int64
+}
+
+func newStreamTracker(config *streaming, r *http.Request, wrapper writerProxy, body *recordingReader) *streamTracker {
+	var t = &streamTracker{
+		config:   config,
+		stat:     xstats.FromRequest(r),
+		r:        r,
+		wrapper:  wrapper,
+		body:     body,
+		lock:     &sync.Mutex{},
+		once:     &sync.Once{},
+		stopOnce: &sync.Once{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	wrapper.OnFlush(t.markFlushed)
+	wrapper.OnHijack(t.hijack)
+	return t
+}
+
+func (t *streamTracker) markFlushed() {
+	atomic.StoreInt32(&t.flushed, 1)
+	t.start()
+}
+
+func (t *streamTracker) hijack(conn net.Conn, rw *bufio.ReadWriter) (net.Conn, *bufio.ReadWriter) {
+	var hijacked = &hijackedConn{
+		Conn:    conn,
+		read:    new(int64),
+		written: new(int64),
+		start:   time.Now(),
+		once:    &sync.Once{},
+	}
+	hijacked.closed = func() {
+		t.closeHijacked(hijacked)
+	}
+	t.lock.Lock()
+	t.hijacked = hijacked
+	t.lock.Unlock()
+	// Data already buffered from the connection is counted as it is read
+	// and writes are sent through the counting connection.
+	rw = bufio.NewReadWriter(
+		bufio.NewReader(&countingReader{Reader: rw.Reader, count: hijacked.read}),
+		bufio.NewWriter(hijacked),
+	)
+	if t.config.track(t) {
+		t.start()
+	}
+	return hijacked, rw
+}
+
+func (t *streamTracker) hijackedConn() *hijackedConn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.hijacked
+}
+
+// activeType returns the kind of a response that is known to be long lived.
+// It does not inspect the response so that it is safe to call while the
+// handler is running.
+func (t *streamTracker) activeType() string {
+	if t.hijackedConn() != nil {
+		if t.r.Header.Get("Upgrade") != "" {
+			return responseTypeUpgraded
+		}
+		return responseTypeHijacked
+	}
+	return responseTypeStream
+}
+
+// responseType returns the kind of response that was served. It must only be
+// called once the handler has returned.
+func (t *streamTracker) responseType() string {
+	if t.hijackedConn() != nil || atomic.LoadInt32(&t.flushed) == 1 {
+		return t.activeType()
+	}
+	if t.wrapper.Status() == http.StatusSwitchingProtocols {
+		return responseTypeUpgraded
+	}
+	if strings.HasPrefix(t.wrapper.Header().Get("Content-Type"), "text/event-stream") {
+		return responseTypeStream
+	}
+	return responseTypeStandard
+}
+
+func (t *streamTracker) tags() []string {
+	return []string{
+		fmt.Sprintf("server_method:%s", t.r.Method),
+		fmt.Sprintf("%s:%s", responseTypeTagName, t.activeType()),
+	}
+}
+
+func (t *streamTracker) start() {
+	t.once.Do(func() {
+		go t.run()
+	})
+}
+
+// report emits the bytes transferred since the previous report.
+func (t *streamTracker) report() {
+	var in = int64(t.body.BytesRead())
+	var out = int64(t.wrapper.BytesWritten())
+	if hijacked := t.hijackedConn(); hijacked != nil {
+		in += atomic.LoadInt64(hijacked.read)
+		out += atomic.LoadInt64(hijacked.written)
+	}
+	var tags = t.tags()
+	t.stat.Count(t.config.bytesIn, float64(in-t.lastIn), tags...)
+	t.stat.Count(t.config.bytesOut, float64(out-t.lastOut), tags...)
+	t.lastIn = in
+	t.lastOut = out
+}
+
+func (t *streamTracker) run() {
+	defer close(t.done)
+	var ticker = time.NewTicker(t.config.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.report()
+		case <-t.stop:
+			t.report()
+			return
+		}
+	}
+}
+
+// halt stops the periodic reporting, if it was started, after a final
+// report and prevents it from starting later.
+func (t *streamTracker) halt() {
+	var started = true
+	t.once.Do(func() {
+		started = false
+	})
+	if started {
+		t.stopOnce.Do(func() {
+			close(t.stop)
+		})
+		<-t.done
+	}
+}
+
+// finish is called once the handler has returned. Reporting continues for
+// hijacked connections until they are closed or the middleware is closed.
+func (t *streamTracker) finish() {
+	if t.hijackedConn() != nil {
+		return
+	}
+	t.halt()
+}
+
+func (t *streamTracker) closeHijacked(hijacked *hijackedConn) {
+	var tags = t.tags()
+	t.stat.Timing(t.config.hijackedTime, time.Since(hijacked.start), tags...)
+	t.stat.Histogram(t.config.hijackedBytesIn, float64(atomic.LoadInt64(hijacked.read)), tags...)
+	t.stat.Histogram(t.config.hijackedBytesOut, float64(atomic.LoadInt64(hijacked.written)), tags...)
+	t.config.untrack(t)
+	t.halt()
+}
+
+// MiddlewareOptionStreaming enables tracking of long lived responses. The
+// standard metrics are tagged with a server_response_type of standard,
+// streaming, upgraded, or hijacked. Responses are considered streaming if the
+// handler flushes them or they use the text/event-stream content type. While
+// a streaming response or hijacked connection is open the bytes transferred
+// during each interval are emitted as the service_stream_bytes_received and
+// service_stream_bytes_returned counters. Hijacked connections, such as
+// WebSocket upgrades, additionally emit a service_hijacked_time timer along
+// with service_hijacked_bytes_received and service_hijacked_bytes_returned
+// histograms when the connection is closed. The interval counters of hijacked
+// connections that are never closed stop when the FlushCloser returned by
+// NewMiddlewareCloser is closed.
+func MiddlewareOptionStreaming(interval time.Duration) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		if interval <= 0 {
+			return nil, fmt.Errorf("streaming interval must be positive: %s", interval)
+		}
+		m.streaming = &streaming{
+			interval:         interval,
+			bytesIn:          "service_stream_bytes_received",
+			bytesOut:         "service_stream_bytes_returned",
+			hijackedTime:     "service_hijacked_time",
+			hijackedBytesIn:  "service_hijacked_bytes_received",
+			hijackedBytesOut: "service_hijacked_bytes_returned",
+			lock:             &sync.Mutex{},
+			hijacked:         make(map[*streamTracker]bool),
+		}
+		return m, nil
+	}
+}
+
+// MiddlewareOptionStreamingNames sets the metric names used for long lived
+// responses. The default values are service_stream_bytes_received,
+// service_stream_bytes_returned, service_hijacked_time,
+// service_hijacked_bytes_received, and service_hijacked_bytes_returned. This
+// option must be given after MiddlewareOptionStreaming.
+func MiddlewareOptionStreamingNames(bytesInName string, bytesOutName string, hijackedTimeName string, hijackedBytesInName string, hijackedBytesOutName string) MiddlewareOption {
+	return func(m *Middleware) (*Middleware, error) {
+		if m.streaming == nil {
+			return nil, fmt.Errorf("streaming is not enabled")
+		}
+		m.streaming.bytesIn = bytesInName
+		m.streaming.bytesOut = bytesOutName
+		m.streaming.hijackedTime = hijackedTimeName
+		m.streaming.hijackedBytesIn = hijackedBytesInName
+		m.streaming.hijackedBytesOut = hijackedBytesOutName
+		return m, nil
+	}
+}
@@ -0,0 +1,216 @@
+package httpstats
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+// streamRecorder collects the values emitted to a mock stat client.
+type streamRecorder struct {
+	lock   *sync.Mutex
+	values map[string]float64
+	tags   map[string][]string
+	done   chan struct{}
+}
+
+func newStreamRecorder(ctrl *gomock.Controller) (*MockXStater, *streamRecorder) {
+	var sender = NewMockXStater(ctrl)
+	var recorder = &streamRecorder{
+		lock:   &sync.Mutex{},
+		values: make(map[string]float64),
+		tags:   make(map[string][]string),
+		done:   make(chan struct{}),
+	}
+	var record = func(name string, value float64, tags ...string) {
+		recorder.lock.Lock()
+		defer recorder.lock.Unlock()
+		recorder.values[name] += value
+		recorder.tags[name] = tags
+	}
+	sender.EXPECT().Count(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Do(record)
+	sender.EXPECT().Histogram(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Do(record)
+	sender.EXPECT().Timing(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().Do(func(name string, value time.Duration, tags ...string) {
+		record(name, float64(value), tags...)
+		if name == "service_time" {
+			close(recorder.done)
+		}
+	})
+	return sender, recorder
+}
+
+func (r *streamRecorder) value(name string) float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.values[name]
+}
+
+func (r *streamRecorder) tagsOf(name string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.tags[name]
+}
+
+func TestMiddlewareOptionStreamingSSE(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender, recorder = newStreamRecorder(ctrl)
+	var result, _, e = NewMiddleware(middlewareOptionSender(sender), MiddlewareOptionStreaming(5*time.Millisecond))
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var server = httptest.NewServer(result(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		_, _ = io.WriteString(w, "data: 2\n\n")
+	})))
+	defer server.Close()
+
+	var resp, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	<-recorder.done
+
+	assert.Equal(t, float64(18), recorder.value("service_stream_bytes_returned"))
+	assert.Equal(t, []string{"server_method:GET", "server_response_type:streaming"}, recorder.tagsOf("service_stream_bytes_returned"))
+	assert.Contains(t, recorder.tagsOf("service_time"), "server_response_type:streaming")
+}
+
+func TestMiddlewareOptionStreamingHijack(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender, recorder = newStreamRecorder(ctrl)
+	var result, _, e = NewMiddleware(middlewareOptionSender(sender), MiddlewareOptionStreaming(time.Hour))
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var upgrade = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n"
+	var finished = make(chan struct{})
+	var handler = result(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var conn, rw, err = w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString(upgrade)
+		_ = rw.Flush()
+		var message = make([]byte, 4)
+		_, _ = io.ReadFull(rw, message)
+		_, _ = conn.Write([]byte("pong"))
+	}))
+	// Hijacked connections are not tracked by the server so the test waits
+	// for the handler to return before completing.
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(finished)
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	var conn, err = net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	_, _ = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\nping")
+	var reader = bufio.NewReader(conn)
+	var response, _ = ioutil.ReadAll(reader)
+	assert.True(t, strings.HasSuffix(string(response), "pong"))
+	<-finished
+	<-recorder.done
+
+	assert.Equal(t, float64(4), recorder.value("service_hijacked_bytes_received"))
+	assert.Equal(t, float64(len(upgrade)+4), recorder.value("service_hijacked_bytes_returned"))
+	assert.Equal(t, []string{"server_method:GET", "server_response_type:upgraded"}, recorder.tagsOf("service_hijacked_time"))
+	assert.Contains(t, recorder.tagsOf("service_time"), "server_response_type:upgraded")
+}
+
+func TestMiddlewareOptionStreamingHijackClose(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender, recorder = newStreamRecorder(ctrl)
+	var result, _, closer, e = NewMiddlewareCloser(middlewareOptionSender(sender), MiddlewareOptionStreaming(time.Hour))
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var upgrade = "HTTP/1.1 101 Switching Protocols\r\n\r\n"
+	var hijacked = make(chan net.Conn, 1)
+	var handler = result(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var conn, _, err = w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		_, _ = conn.Write([]byte(upgrade))
+		// The handler returns without closing the connection.
+		hijacked <- conn
+	})).(*Middleware)
+	var server = httptest.NewServer(handler)
+	defer server.Close()
+
+	var conn, err = net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	_, _ = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	var serverConn = <-hijacked
+	defer serverConn.Close()
+	<-recorder.done
+	assert.Len(t, handler.streaming.hijacked, 1)
+
+	assert.NoError(t, closer.Close(context.Background()))
+	assert.Empty(t, handler.streaming.hijacked)
+	assert.Equal(t, float64(len(upgrade)), recorder.value("service_stream_bytes_returned"))
+}
+
+func TestMiddlewareOptionStreamingStandard(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var result, _, e = NewMiddleware(
+		middlewareOptionSender(sender),
+		MiddlewareOptionStreaming(time.Hour),
+		MiddlewareOptionStreamingNames("in", "out", "hijacked", "hijackedin", "hijackedout"),
+	)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	var m = result(fixtureHandler{}).(*Middleware)
+	assert.Equal(t, "hijackedout", m.streaming.hijackedBytesOut)
+
+	var tags = []interface{}{"server_method:GET", "server_status_code:200", "server_status:ok", "server_response_type:standard"}
+	sender.EXPECT().Timing(m.requestTime, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesIn, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesOut, gomock.Any(), tags...)
+	sender.EXPECT().Histogram(m.bytesTotal, gomock.Any(), tags...)
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestMiddlewareOptionStreamingInvalid(t *testing.T) {
+	var _, _, e = NewMiddleware(MiddlewareOptionStreaming(0))
+	assert.Error(t, e)
+	_, _, e = NewMiddleware(MiddlewareOptionStreamingNames("a", "b", "c", "d", "e"))
+	assert.Error(t, e)
+}
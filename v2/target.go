@@ -0,0 +1,147 @@
+package httpstats
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	otherTarget = "other"
+)
+
+// targetHost returns the lowercase host of the request without the port or
+// any trailing dot.
+func targetHost(r *http.Request) string {
+	var host = r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	if h, _, e := net.SplitHostPort(host); e == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// RequestTaggerTargetHost tags client metrics with the target_host of the
+// request. The host is lowercased and any port is removed. If hosts are
+// given then only those hosts are reported and all others are tagged as
+// other. A host beginning with "*." matches any subdomain of the remaining
+// name. If no hosts are given then at most 100 distinct hosts are reported
+// within a sliding window of one hour and any further hosts are tagged as
+// other until older hosts age out of the window.
+func RequestTaggerTargetHost(hosts ...string) RequestTagger {
+	if len(hosts) < 1 {
+		return requestTaggerTargetHostLimit(defaultCardinalityLimit, defaultCardinalityWindow)
+	}
+	var exact = make(map[string]bool, len(hosts))
+	var suffixes []string
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		if strings.HasPrefix(host, "*.") {
+			suffixes = append(suffixes, host[1:])
+			continue
+		}
+		exact[host] = true
+	}
+	return func(r *http.Request) (string, string) {
+		var host = targetHost(r)
+		if exact[host] {
+			return "target_host", host
+		}
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(host, suffix) {
+				return "target_host", host
+			}
+		}
+		return "target_host", otherTarget
+	}
+}
+
+// requestTaggerTargetHostLimit reports at most limit distinct hosts within the
+// window and tags all others as other.
+func requestTaggerTargetHostLimit(limit int, window time.Duration) RequestTagger {
+	var limiter = newCardinalityLimiter(limit, window, otherTarget)
+	return func(r *http.Request) (string, string) {
+		return "target_host", limiter.value("target_host", targetHost(r))
+	}
+}
+
+// RequestTaggerTargetScheme tags client metrics with the target_scheme of the
+// request, such as http or https.
+func RequestTaggerTargetScheme() RequestTagger {
+	return func(r *http.Request) (string, string) {
+		var scheme = strings.ToLower(r.URL.Scheme)
+		switch scheme {
+		case "http", "https":
+			return "target_scheme", scheme
+		}
+		return "target_scheme", otherTarget
+	}
+}
+
+type routeTemplate struct {
+	template string
+	segments []string
+	catchAll bool
+}
+
+func newRouteTemplate(template string) routeTemplate {
+	var segments = strings.Split(strings.Trim(template, "/"), "/")
+	var result = routeTemplate{template: template}
+	for offset, segment := range segments {
+		if offset == len(segments)-1 && (strings.HasPrefix(segment, "*") || (strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "...}"))) {
+			result.catchAll = true
+			break
+		}
+		result.segments = append(result.segments, segment)
+	}
+	return result
+}
+
+func (t routeTemplate) match(segments []string) bool {
+	if len(segments) < len(t.segments) || (!t.catchAll && len(segments) != len(t.segments)) {
+		return false
+	}
+	for offset, segment := range t.segments {
+		if isRouteParameter(segment) {
+			if segments[offset] == "" {
+				return false
+			}
+			continue
+		}
+		if segment != segments[offset] {
+			return false
+		}
+	}
+	return true
+}
+
+func isRouteParameter(segment string) bool {
+	return strings.HasPrefix(segment, ":") || (strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}"))
+}
+
+// RequestTaggerTargetRoute tags client metrics with the target_route that the
+// request path matches from the given table of path templates. Templates may
+// contain parameters in the "{name}" or ":name" form which match a single
+// path segment and may end with a "*name" or "{name...}" segment which matches
+// the remainder of the path. Templates are evaluated in the order given and
+// the first match is used. Paths that do not match any template are tagged as
+// unmatched.
+func RequestTaggerTargetRoute(templates ...string) RequestTagger {
+	var routes = make([]routeTemplate, 0, len(templates))
+	for _, template := range templates {
+		routes = append(routes, newRouteTemplate(template))
+	}
+	return func(r *http.Request) (string, string) {
+		var segments = strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		for _, route := range routes {
+			if route.match(segments) {
+				return "target_route", route.template
+			}
+		}
+		return "target_route", unmatchedRoute
+	}
+}
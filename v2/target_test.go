@@ -0,0 +1,125 @@
+package httpstats
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/xstats"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+)
+
+func TestRequestTaggerTargetHost(t *testing.T) {
+	var tagger = RequestTaggerTargetHost()
+	var cases = map[string]string{
+		"http://Example.COM:8080/":  "example.com",
+		"https://example.com./path": "example.com",
+		"http://[::1]:8080/":        "::1",
+		"http://10.0.0.1/":          "10.0.0.1",
+	}
+	for target, expected := range cases {
+		var key, value = tagger(httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, "target_host", key)
+		assert.Equal(t, expected, value, target)
+	}
+
+	tagger = requestTaggerTargetHostLimit(2, time.Minute)
+	cases = map[string]string{
+		"http://a.example.com/":      "a.example.com",
+		"http://b.example.com/":      "b.example.com",
+		"http://A.example.com:8080/": "a.example.com",
+		"http://c.example.com/":      "other",
+	}
+	for _, target := range []string{"http://a.example.com/", "http://b.example.com/", "http://A.example.com:8080/", "http://c.example.com/"} {
+		var _, value = tagger(httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, cases[target], value, target)
+	}
+
+	tagger = RequestTaggerTargetHost("api.example.com", "*.internal.example.com")
+	cases = map[string]string{
+		"http://API.example.com:443/":        "api.example.com",
+		"http://users.internal.example.com/": "users.internal.example.com",
+		"http://internal.example.com/":       "other",
+		"http://random.example.org/":         "other",
+	}
+	for target, expected := range cases {
+		var _, value = tagger(httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, expected, value, target)
+	}
+}
+
+func TestRequestTaggerTargetHostWindow(t *testing.T) {
+	var now = time.Unix(1000, 0)
+	var limiter = newCardinalityLimiter(1, time.Minute, otherTarget)
+	limiter.now = func() time.Time { return now }
+	assert.Equal(t, "a.example.com", limiter.value("target_host", "a.example.com"))
+	assert.Equal(t, otherTarget, limiter.value("target_host", "b.example.com"))
+
+	// Hosts that have not been seen for a full window make room for new ones.
+	now = now.Add(time.Minute)
+	assert.Equal(t, "b.example.com", limiter.value("target_host", "b.example.com"))
+	assert.Equal(t, otherTarget, limiter.value("target_host", "a.example.com"))
+}
+
+func TestRequestTaggerTargetScheme(t *testing.T) {
+	var tagger = RequestTaggerTargetScheme()
+	var key, value = tagger(httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	assert.Equal(t, "target_scheme", key)
+	assert.Equal(t, "https", value)
+	var r = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.URL.Scheme = "ftp"
+	_, value = tagger(r)
+	assert.Equal(t, "other", value)
+}
+
+func TestRequestTaggerTargetRoute(t *testing.T) {
+	var tagger = RequestTaggerTargetRoute(
+		"/",
+		"/users/me",
+		"/users/{id}",
+		"/users/:id/groups/:group",
+		"/files/*filepath",
+		"/static/{path...}",
+	)
+	var cases = map[string]string{
+		"/":                 "/",
+		"/users/me":         "/users/me",
+		"/users/1234":       "/users/{id}",
+		"/users/1234/":      "/users/{id}",
+		"/users/1/groups/2": "/users/:id/groups/:group",
+		"/files":            "/files/*filepath",
+		"/files/a/b/c.txt":  "/files/*filepath",
+		"/static/app.js":    "/static/{path...}",
+		"/users":            "unmatched",
+		"/users/1/groups":   "unmatched",
+		"/missing":          "unmatched",
+	}
+	for path, expected := range cases {
+		var key, value = tagger(httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		assert.Equal(t, "target_route", key)
+		assert.Equal(t, expected, value, path)
+	}
+}
+
+func TestTransportTargetTaggers(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var sender = NewMockXStater(ctrl)
+	var stat = xstats.New(sender)
+	var r = NewTransport(
+		TransportOptionRequestTag(RequestTaggerTargetHost()),
+		TransportOptionRequestTag(RequestTaggerTargetScheme()),
+		TransportOptionRequestTag(RequestTaggerTargetRoute("/users/{id}")),
+	)(statusTransport(http.StatusOK))
+
+	var tags = []interface{}{"target_host:example.com", "target_scheme:https", "target_route:/users/{id}"}
+	sender.EXPECT().Timing("client_request_time", gomock.Any(), append(tags, "method:GET", "status_code:200", "status:ok")...)
+	sender.EXPECT().Histogram("client_request_bytes_received", gomock.Any(), tags...)
+	var req = httptest.NewRequest(http.MethodGet, "https://example.com:8443/users/1234", nil)
+	var _, e = r.RoundTrip(req.WithContext(xstats.NewContext(context.Background(), stat)))
+	assert.NoError(t, e)
+}
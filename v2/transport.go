@@ -5,8 +5,10 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptrace"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,7 +23,11 @@ type recordingClientResponseBodyReadCloser struct {
 	statName         string
 	totalStatName    string
 	tags             []string
-	ctx              context.Context
+	stat             xstats.XStater
+	release          func()
+	encoding         *contentEncoding
+	decoding         *decodingReadCloser
+	distributions    *distributions
 }
 
 func (r *recordingClientResponseBodyReadCloser) Read(p []byte) (int, error) {
@@ -32,8 +38,16 @@ func (r *recordingClientResponseBodyReadCloser) Read(p []byte) (int, error) {
 
 func (r *recordingClientResponseBodyReadCloser) Close() error {
 	var bytesRead = float64(atomic.LoadInt32(r.bytesRead))
-	xstats.FromContext(r.ctx).Histogram(r.statName, bytesRead, r.tags...)
-	xstats.FromContext(r.ctx).Histogram(r.totalStatName, bytesRead+float64(r.requestBytesRead), r.tags...)
+	var wireBytes = bytesRead
+	if r.decoding != nil {
+		wireBytes = float64(r.decoding.wireBytes())
+	}
+	r.distributions.histogram(r.stat, r.statName, wireBytes, r.tags)
+	r.distributions.histogram(r.stat, r.totalStatName, wireBytes+float64(r.requestBytesRead), r.tags)
+	if r.encoding != nil {
+		r.encoding.record(r.stat, int(wireBytes), int(bytesRead), r.decoding != nil, r.tags)
+	}
+	r.release()
 	return r.ReadCloser.Close()
 }
 
@@ -53,18 +67,40 @@ type traceStater struct {
 	wroteHeadersName   string
 	firstByteName      string
 	putIdleName        string
-}
-
+	connectName        string
+	dialAttemptsName   string
+	connectStarts      map[string]time.Time
+	tlsDetails         bool
+	certExpiryName     string
+	pool               *poolTracker
+	hostPort           string
+	conn               *pooledConn
+	held               net.Conn
+}
+
+// getConn records the address of the connection unless the target of the
+// request was already set, which is the case when connections are counted
+// because the address is that of the proxy when one is used.
 func (t *traceStater) getConn(hostPort string) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	t.getConnTime = time.Now()
+	if t.hostPort == "" {
+		t.hostPort = hostPort
+	}
 }
 
 func (t *traceStater) gotConn(info httptrace.GotConnInfo) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	t.gotConnTime = time.Now()
+	if t.pool != nil {
+		if t.held != nil {
+			t.pool.release(t.hostPort, t.held)
+		}
+		t.conn = t.pool.acquire(t.hostPort, info.Conn)
+		t.held = info.Conn
+	}
 	var d = time.Since(t.getConnTime)
 	var tags = append(t.tags[:], fmt.Sprintf("reused:%v", info.Reused), fmt.Sprintf("idle:%v", info.WasIdle))
 	t.stat.Timing(t.gotConnectionName, d, tags...)
@@ -98,9 +134,40 @@ func (t *traceStater) tlsHandshakeDone(info tls.ConnectionState, e error) {
 	defer t.lock.Unlock()
 	var d = time.Since(t.tlsStartTime)
 	var tags = append(t.tags[:], fmt.Sprintf("error:%v", e != nil))
+	if t.tlsDetails && e == nil {
+		tags = append(tags, tlsTags(info)...)
+		if len(info.PeerCertificates) > 0 {
+			var host = info.ServerName
+			if host == "" {
+				host, _, _ = net.SplitHostPort(t.hostPort)
+			}
+			var expiry = time.Until(info.PeerCertificates[0].NotAfter).Hours() / 24
+			t.stat.Gauge(t.certExpiryName, expiry, append(t.tags[:], fmt.Sprintf("host:%s", host))...)
+		}
+	}
 	t.stat.Timing(t.tlsName, d, tags...)
 }
 
+// tlsVersionName returns a tag friendly name for a TLS version, such as
+// tls1.3.
+func tlsVersionName(version uint16) string {
+	return strings.ToLower(strings.ReplaceAll(tls.VersionName(version), " ", ""))
+}
+
+// tlsTags returns the tags that describe a negotiated TLS session.
+func tlsTags(info tls.ConnectionState) []string {
+	var protocol = info.NegotiatedProtocol
+	if protocol == "" {
+		protocol = "none"
+	}
+	return []string{
+		fmt.Sprintf("tls_version:%s", tlsVersionName(info.Version)),
+		fmt.Sprintf("cipher_suite:%s", tls.CipherSuiteName(info.CipherSuite)),
+		fmt.Sprintf("alpn:%s", protocol),
+		fmt.Sprintf("resumed:%v", info.DidResume),
+	}
+}
+
 func (t *traceStater) wroteHeaders() {
 	t.lock.Lock()
 	defer t.lock.Unlock()
@@ -121,10 +188,75 @@ func (t *traceStater) putIdleConn(e error) {
 	defer t.lock.Unlock()
 	var tags = append(t.tags[:], fmt.Sprintf("error:%v", e != nil))
 	t.stat.Count(t.putIdleName, 1, tags...)
+	if t.pool != nil && t.conn != nil && e == nil {
+		t.pool.putIdle(t.conn)
+	}
+}
+
+// addressFamily returns ipv4 or ipv6 for the IP address of a dialed address
+// or unknown if the address is not an IP address.
+func addressFamily(addr string) string {
+	var host, _, e = net.SplitHostPort(addr)
+	if e != nil {
+		host = addr
+	}
+	var ip = net.ParseIP(host)
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
 }
 
-func newClientTrace(stat xstats.XStater, tags []string, gotConnectionName string, connectionIdleName string, dnsName string, tlsName string, wroteHeadersName string, firstByteName string, putIdleName string) *httptrace.ClientTrace {
-	var tstat = &traceStater{
+// connectStart and connectDone are called for each address dialed. Multiple
+// addresses may be dialed concurrently when both IPv4 and IPv6 addresses are
+// available so each attempt is timed separately.
+func (t *traceStater) connectStart(network string, addr string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.connectStarts == nil {
+		t.connectStarts = make(map[string]time.Time)
+	}
+	t.connectStarts[network+" "+addr] = time.Now()
+	var tags = append(t.tags[:], fmt.Sprintf("network:%s", network), fmt.Sprintf("address_family:%s", addressFamily(addr)))
+	t.stat.Count(t.dialAttemptsName, 1, tags...)
+	if t.pool != nil {
+		t.pool.dialing(t.hostPort, 1)
+	}
+}
+
+func (t *traceStater) connectDone(network string, addr string, e error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if start, ok := t.connectStarts[network+" "+addr]; ok {
+		delete(t.connectStarts, network+" "+addr)
+		var tags = append(t.tags[:], fmt.Sprintf("network:%s", network), fmt.Sprintf("address_family:%s", addressFamily(addr)), fmt.Sprintf("error:%v", e != nil))
+		t.stat.Timing(t.connectName, time.Since(start), tags...)
+	}
+	if t.pool != nil {
+		t.pool.dialing(t.hostPort, -1)
+	}
+}
+
+// release records that the request no longer holds its connection. It is
+// safe to call more than once.
+func (t *traceStater) release() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.held != nil {
+		t.pool.release(t.hostPort, t.held)
+		t.held = nil
+	}
+}
+
+func newClientTrace(stat xstats.XStater, tags []string, gotConnectionName string, connectionIdleName string, dnsName string, tlsName string, wroteHeadersName string, firstByteName string, putIdleName string, connectName string, dialAttemptsName string) *httptrace.ClientTrace {
+	return newTraceStater(stat, tags, gotConnectionName, connectionIdleName, dnsName, tlsName, wroteHeadersName, firstByteName, putIdleName, connectName, dialAttemptsName).clientTrace()
+}
+
+func newTraceStater(stat xstats.XStater, tags []string, gotConnectionName string, connectionIdleName string, dnsName string, tlsName string, wroteHeadersName string, firstByteName string, putIdleName string, connectName string, dialAttemptsName string) *traceStater {
+	return &traceStater{
 		stat:               stat,
 		tags:               tags,
 		lock:               &sync.Mutex{},
@@ -135,77 +267,155 @@ func newClientTrace(stat xstats.XStater, tags []string, gotConnectionName string
 		wroteHeadersName:   wroteHeadersName,
 		firstByteName:      firstByteName,
 		putIdleName:        putIdleName,
+		connectName:        connectName,
+		dialAttemptsName:   dialAttemptsName,
 	}
+}
+
+func (t *traceStater) clientTrace() *httptrace.ClientTrace {
 	return &httptrace.ClientTrace{
-		GetConn:              tstat.getConn,
-		GotConn:              tstat.gotConn,
-		DNSStart:             tstat.dnsStart,
-		DNSDone:              tstat.dnsDone,
-		TLSHandshakeStart:    tstat.tlsHandshakeStart,
-		TLSHandshakeDone:     tstat.tlsHandshakeDone,
-		WroteHeaders:         tstat.wroteHeaders,
-		GotFirstResponseByte: tstat.firstByte,
-		PutIdleConn:          tstat.putIdleConn,
+		GetConn:              t.getConn,
+		GotConn:              t.gotConn,
+		DNSStart:             t.dnsStart,
+		DNSDone:              t.dnsDone,
+		TLSHandshakeStart:    t.tlsHandshakeStart,
+		TLSHandshakeDone:     t.tlsHandshakeDone,
+		WroteHeaders:         t.wroteHeaders,
+		GotFirstResponseByte: t.firstByte,
+		PutIdleConn:          t.putIdleConn,
+		ConnectStart:         t.connectStart,
+		ConnectDone:          t.connectDone,
 	}
 }
 
 // Transport is an http.RoundTripper wrapper that instruments HTTP clients with
 // the standard SecDev metrics.
 type Transport struct {
-	tags           []string
-	next           http.RoundTripper
-	requestTime    string
-	bytesIn        string
-	bytesOut       string
-	bytesTotal     string
-	gotConnection  string
-	connectionIdle string
-	dns            string
-	tls            string
-	wroteHeader    string
-	firstByte      string
-	putIdle        string
-	requestTaggers []func(*http.Request) (string, string)
+	tags               []string
+	next               http.RoundTripper
+	requestTime        string
+	bytesIn            string
+	bytesOut           string
+	bytesTotal         string
+	gotConnection      string
+	connectionIdle     string
+	dns                string
+	tls                string
+	wroteHeader        string
+	firstByte          string
+	putIdle            string
+	connect            string
+	dialAttempts       string
+	tlsDetails         bool
+	certExpiry         string
+	requestTaggers     []func(*http.Request) (string, string)
+	cardinality        *cardinalityLimiter
+	cardinalityClamped string
+	senders            []xstats.Sender
+	statusClassifier   StatusClassifier
+	pool               *poolTracker
+	poolNames          []string
+	headerSizes        *headerSizes
+	headerSizeNames    []string
+	contentEncoding    *contentEncoding
+	encodingNames      []string
+	distributions      *distributions
+	distributionNames  []string
+	closeOnce          *sync.Once
+}
+
+// stat returns the stat client used to emit metrics for the request. If any
+// additional senders are configured then the returned client emits to those
+// senders as well as the stat client of the request.
+func (t *Transport) stat(r *http.Request) xstats.XStater {
+	var stat = xstats.FromRequest(r)
+	if len(t.senders) < 1 {
+		return stat
+	}
+	return &teeStater{
+		XStater: stat,
+		sender:  xstats.MultiSender(t.senders),
+		tags:    []string{fmt.Sprintf("server_address:%s", r.URL.Hostname())},
+	}
 }
 
 // RoundTrip instruments the HTTP request/response cycle with metrics.
 func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 	var method = r.Method
+	var stat = t.stat(r)
 	var tags = make([]string, 0, len(t.requestTaggers))
 	for _, tagger := range t.requestTaggers {
 		var k, v = tagger(r)
 		tags = append(tags, fmt.Sprintf("%s:%s", k, v))
 	}
 	tags = append(tags, t.tags...)
+	if t.cardinality != nil {
+		var clamped []string
+		tags, clamped = t.cardinality.apply(tags)
+		for _, key := range clamped {
+			stat.Count(t.cardinalityClamped, 1, fmt.Sprintf("tag_key:%s", key))
+		}
+	}
 	var bodyWrapper = &recordingReader{r.Body, new(int32)}
 	if r.Body != nil {
 		r.Body = bodyWrapper
 	}
-	r = r.WithContext(
-		httptrace.WithClientTrace(
-			r.Context(),
-			newClientTrace(
-				xstats.FromRequest(r),
-				tags,
-				t.gotConnection,
-				t.connectionIdle,
-				t.dns,
-				t.tls,
-				t.wroteHeader,
-				t.firstByte,
-				t.putIdle,
-			),
-		),
+	var tstat = newTraceStater(
+		stat,
+		tags,
+		t.gotConnection,
+		t.connectionIdle,
+		t.dns,
+		t.tls,
+		t.wroteHeader,
+		t.firstByte,
+		t.putIdle,
+		t.connect,
+		t.dialAttempts,
 	)
+	var ctx = r.Context()
+	if t.pool != nil {
+		tstat.pool = t.pool
+		tstat.hostPort = poolTarget(r.URL)
+		ctx = context.WithValue(ctx, poolTargetContextKey{}, tstat.hostPort)
+	}
+	tstat.tlsDetails = t.tlsDetails
+	tstat.certExpiryName = t.certExpiry
+	// The headers are measured as given because the http.Transport would
+	// otherwise have added the Accept-Encoding header of requestCompression.
+	var original = r
+	var compressed = false
+	if t.contentEncoding != nil {
+		r, compressed = requestCompression(t.next, r)
+	}
+	r = r.WithContext(httptrace.WithClientTrace(ctx, tstat.clientTrace()))
 	var start = time.Now()
 	var resp, e = t.next.RoundTrip(r)
 	var duration = time.Since(start)
-	var statusCode string
-	var status string
+	var statusCode, status = roundTripOutcome(t.statusClassifier, r, resp, e)
+	var byteTags = tags
+	var encoding *contentEncoding
+	var decoding *decodingReadCloser
+	if t.contentEncoding != nil {
+		var responseEncoding = encodingNone
+		if e == nil {
+			responseEncoding = contentEncodingName(resp.Header)
+			if compressed {
+				decoding = decompressResponse(resp)
+			}
+			switch {
+			case decoding != nil || responseEncoding == encodingIdentity && !resp.Uncompressed:
+				encoding = t.contentEncoding
+			case resp.Uncompressed:
+				// The response was decompressed by the wrapped transport so
+				// only the decoded size is known.
+				responseEncoding = "gzip"
+			}
+		}
+		byteTags = encodingTags(tags, requestEncodingTagName, contentEncodingName(r.Header), responseEncodingTagName, responseEncoding)
+	}
 	var bytesRead = 0
 	if e == nil {
-		statusCode = fmt.Sprintf("%d", resp.StatusCode)
-		status = responseStatus(r.Context(), resp.StatusCode)
 		if r.Body != nil {
 			bytesRead = bodyWrapper.BytesRead()
 		}
@@ -215,20 +425,48 @@ func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 			requestBytesRead: bytesRead,
 			statName:         t.bytesOut,
 			totalStatName:    t.bytesTotal,
-			tags:             tags,
-			ctx:              r.Context(),
+			tags:             byteTags,
+			stat:             stat,
+			release:          tstat.release,
+			encoding:         encoding,
+			decoding:         decoding,
+			distributions:    t.distributions,
 		}
 	} else {
-		var errorStatusCode = errorToStatusCode(e)
-		statusCode = fmt.Sprintf("%d", errorStatusCode)
-		status = responseStatus(r.Context(), errorStatusCode)
+		tstat.release()
+	}
+	var timerTags = append(tags, fmt.Sprintf("method:%s", method), fmt.Sprintf("status_code:%d", statusCode), fmt.Sprintf("status:%s", status))
+	if attempt, ok := AttemptFromContext(r.Context()); ok {
+		timerTags = append(timerTags, fmt.Sprintf("attempt:%d", attempt))
+	}
+	t.distributions.timing(stat, t.requestTime, duration, timerTags)
+	t.distributions.histogram(stat, t.bytesIn, float64(bytesRead), byteTags)
+	if t.headerSizes != nil {
+		var host = r.Host
+		if host == "" {
+			host = r.URL.Host
+		}
+		t.headerSizes.recordRequest(stat, requestHeader(original, host), tags)
+		if e == nil {
+			t.headerSizes.recordResponse(stat, resp.Header, tags)
+		}
 	}
-	var timerTags = append(tags, fmt.Sprintf("method:%s", method), fmt.Sprintf("status_code:%s", statusCode), fmt.Sprintf("status:%s", status))
-	xstats.FromRequest(r).Timing(t.requestTime, duration, timerTags...)
-	xstats.FromRequest(r).Histogram(t.bytesIn, float64(bytesRead), tags...)
 	return resp, e
 }
 
+// roundTripOutcome returns the status code and status recorded for the result
+// of a round trip. Requests that failed without a response are given a status
+// code derived from the error.
+func roundTripOutcome(classifier StatusClassifier, r *http.Request, resp *http.Response, err error) (int, string) {
+	var statusCode int
+	if err == nil {
+		statusCode = resp.StatusCode
+	} else {
+		statusCode = errorToStatusCode(err)
+	}
+	return statusCode, classifier(r, statusCode, r.Context().Err())
+}
+
 // TransportOption is used to configure the HTTP transport middleware.
 type TransportOption func(*Transport) *Transport
 
@@ -351,6 +589,48 @@ func TransportOptionPutIdleName(name string) TransportOption {
 	}
 }
 
+// TransportOptionConnectName sets the name of the metric used to track the
+// duration of each attempt to establish a connection to the remote server.
+// The default value is client_connect.
+func TransportOptionConnectName(name string) TransportOption {
+	return func(m *Transport) *Transport {
+		m.connect = name
+		return m
+	}
+}
+
+// TransportOptionDialAttemptsName sets the name of the metric used to count
+// the number of attempts to establish a connection to the remote server. The
+// default value is client_dial_attempts.
+func TransportOptionDialAttemptsName(name string) TransportOption {
+	return func(m *Transport) *Transport {
+		m.dialAttempts = name
+		return m
+	}
+}
+
+// TransportOptionTLSDetails enables tagging of the client_tls metric with
+// the negotiated tls_version, cipher_suite, alpn protocol, and whether the
+// session was resumed. A client_tls_cert_expiry gauge of the number of days
+// until the leaf certificate of the remote server expires is also emitted
+// after each handshake, tagged with the host.
+func TransportOptionTLSDetails() TransportOption {
+	return func(m *Transport) *Transport {
+		m.tlsDetails = true
+		return m
+	}
+}
+
+// TransportOptionTLSCertExpiryName sets the name of the metric used to track
+// the number of days until the certificate of the remote server expires. The
+// default value is client_tls_cert_expiry.
+func TransportOptionTLSCertExpiryName(name string) TransportOption {
+	return func(m *Transport) *Transport {
+		m.certExpiry = name
+		return m
+	}
+}
+
 // RequestTagger functions are invoked by the httpstats.Transport with the *http.Request
 // and return a key and value to tag on each stat emitted for that request during the RoundTrip.
 type RequestTagger func(*http.Request) (string, string)
@@ -370,22 +650,50 @@ func NewTransport(options ...TransportOption) func(http.RoundTripper) http.Round
 	xstats.DisablePooling = true
 	return func(next http.RoundTripper) http.RoundTripper {
 		var m = &Transport{
-			bytesIn:        "client_request_bytes_received",
-			bytesOut:       "client_request_bytes_sent",
-			bytesTotal:     "client_request_bytes_total",
-			requestTime:    "client_request_time",
-			gotConnection:  "client_got_connection",
-			connectionIdle: "client_connection_idle",
-			dns:            "client_dns",
-			tls:            "client_tls",
-			wroteHeader:    "client_wrote_headers",
-			firstByte:      "client_first_response_byte",
-			putIdle:        "client_put_idle",
-			next:           next,
+			bytesIn:            "client_request_bytes_received",
+			bytesOut:           "client_request_bytes_sent",
+			bytesTotal:         "client_request_bytes_total",
+			requestTime:        "client_request_time",
+			gotConnection:      "client_got_connection",
+			connectionIdle:     "client_connection_idle",
+			dns:                "client_dns",
+			tls:                "client_tls",
+			wroteHeader:        "client_wrote_headers",
+			firstByte:          "client_first_response_byte",
+			putIdle:            "client_put_idle",
+			connect:            "client_connect",
+			dialAttempts:       "client_dial_attempts",
+			certExpiry:         "client_tls_cert_expiry",
+			next:               next,
+			cardinalityClamped: "client_tag_cardinality_clamped",
+			statusClassifier:   StatusClassifierDefault,
+			closeOnce:          &sync.Once{},
 		}
 		for _, option := range options {
 			m = option(m)
 		}
+		if m.cardinality != nil {
+			m.cardinality.useDefaults()
+		}
+		if m.headerSizes != nil && m.headerSizeNames != nil {
+			var names = m.headerSizeNames
+			m.headerSizes.setNames(names[0], names[1], names[2], names[3], names[4], names[5])
+		}
+		if m.contentEncoding != nil && m.encodingNames != nil {
+			m.contentEncoding.decodedName = m.encodingNames[0]
+			m.contentEncoding.ratioName = m.encodingNames[1]
+		}
+		if m.distributions != nil {
+			m.distributions.custom = m.distributionNames
+			m.distributions.resolve(m.requestTime, m.bytesIn, m.bytesOut, m.bytesTotal)
+		}
+		if m.pool != nil {
+			if m.poolNames != nil {
+				m.pool.setNames(m.poolNames)
+			}
+			m.next = m.pool.wrapTransport(m.next)
+			go m.pool.run()
+		}
 		return m
 	}
 }
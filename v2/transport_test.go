@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httptrace"
 	"testing"
+	"time"
 
 	"github.com/rs/xstats"
 	"github.com/stretchr/testify/assert"
@@ -21,7 +23,7 @@ func TestTraceStats(t *testing.T) {
 	defer ctrl.Finish()
 
 	var stat = NewMockXStater(ctrl)
-	var trace = newClientTrace(stat, []string{"test:test"}, "gotconn", "connectionidle", "dns", "tls", "wroteheader", "firstbyte", "putidle")
+	var trace = newClientTrace(stat, []string{"test:test"}, "gotconn", "connectionidle", "dns", "tls", "wroteheader", "firstbyte", "putidle", "connect", "dialattempts")
 
 	stat.EXPECT().Timing("gotconn", gomock.Any(), "test:test", "reused:false", "idle:false")
 	trace.GetConn("")
@@ -58,6 +60,56 @@ func TestTraceStats(t *testing.T) {
 	trace.PutIdleConn(nil)
 	stat.EXPECT().Count("putidle", gomock.Any(), "test:test", "error:true")
 	trace.PutIdleConn(errors.New(""))
+
+	stat.EXPECT().Count("dialattempts", float64(1), "test:test", "network:tcp", "address_family:ipv4")
+	stat.EXPECT().Count("dialattempts", float64(1), "test:test", "network:tcp", "address_family:ipv6")
+	stat.EXPECT().Timing("connect", gomock.Any(), "test:test", "network:tcp", "address_family:ipv6", "error:true")
+	stat.EXPECT().Timing("connect", gomock.Any(), "test:test", "network:tcp", "address_family:ipv4", "error:false")
+	trace.ConnectStart("tcp", "127.0.0.1:80")
+	trace.ConnectStart("tcp", "[::1]:80")
+	trace.ConnectDone("tcp", "[::1]:80", errors.New(""))
+	trace.ConnectDone("tcp", "127.0.0.1:80", nil)
+}
+
+func TestTraceStatsTLSDetails(t *testing.T) {
+	var ctrl = gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var stat = NewMockXStater(ctrl)
+	var tstat = newTraceStater(stat, []string{"test:test"}, "gotconn", "connectionidle", "dns", "tls", "wroteheader", "firstbyte", "putidle", "connect", "dialattempts")
+	tstat.tlsDetails = true
+	tstat.certExpiryName = "expiry"
+	var trace = tstat.clientTrace()
+	var state = tls.ConnectionState{
+		Version:            tls.VersionTLS13,
+		CipherSuite:        tls.TLS_AES_128_GCM_SHA256,
+		NegotiatedProtocol: "h2",
+		DidResume:          true,
+		ServerName:         "example.com",
+		PeerCertificates:   []*x509.Certificate{{NotAfter: time.Now().Add(10*24*time.Hour + time.Hour)}},
+	}
+
+	stat.EXPECT().Gauge("expiry", gomock.Any(), "test:test", "host:example.com").Do(func(_ string, days float64, _ ...string) {
+		assert.InDelta(t, 10, days, 0.1)
+	})
+	stat.EXPECT().Timing("tls", gomock.Any(), "test:test", "error:false", "tls_version:tls1.3", "cipher_suite:TLS_AES_128_GCM_SHA256", "alpn:h2", "resumed:true")
+	trace.TLSHandshakeStart()
+	trace.TLSHandshakeDone(state, nil)
+
+	stat.EXPECT().Timing("tls", gomock.Any(), "test:test", "error:true")
+	trace.TLSHandshakeStart()
+	trace.TLSHandshakeDone(tls.ConnectionState{}, errors.New(""))
+
+	stat.EXPECT().Timing("tls", gomock.Any(), "test:test", "error:false", "tls_version:tls1.2", "cipher_suite:TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "alpn:none", "resumed:false")
+	trace.TLSHandshakeStart()
+	trace.TLSHandshakeDone(tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, nil)
+}
+
+func TestAddressFamily(t *testing.T) {
+	assert.Equal(t, "ipv4", addressFamily("10.0.0.1:443"))
+	assert.Equal(t, "ipv6", addressFamily("[2001:db8::1]:443"))
+	assert.Equal(t, "ipv4", addressFamily("10.0.0.1"))
+	assert.Equal(t, "unknown", addressFamily("example.com:443"))
 }
 
 type fixtureTransport struct {
@@ -70,6 +122,8 @@ func (r *fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error)
 	trace.DNSStart(httptrace.DNSStartInfo{})
 	trace.DNSDone(httptrace.DNSDoneInfo{})
 	trace.GetConn("")
+	trace.ConnectStart("tcp", "127.0.0.1:80")
+	trace.ConnectDone("tcp", "127.0.0.1:80", nil)
 	trace.GotConn(httptrace.GotConnInfo{})
 	trace.TLSHandshakeStart()
 	trace.TLSHandshakeDone(tls.ConnectionState{}, nil)
@@ -98,6 +152,8 @@ func TestTransportOptions(t *testing.T) {
 		TransportOptionWroteHeadersName("wroteheaders"),
 		TransportOptionFirstResponseByteName("firstbyte"),
 		TransportOptionPutIdleName("putidle"),
+		TransportOptionConnectName("connect"),
+		TransportOptionDialAttemptsName("dialattempts"),
 	)
 	var r = result(&fixtureTransport{
 		response: &http.Response{
@@ -113,6 +169,8 @@ func TestTransportOptions(t *testing.T) {
 	sender.EXPECT().Histogram("bytesout", gomock.Any(), "test2:test2", "test:test")
 	sender.EXPECT().Histogram("bytestotal", gomock.Any(), "test2:test2", "test:test")
 	sender.EXPECT().Timing("dns", gomock.Any(), "test2:test2", "test:test", "coalesced:false", "error:false")
+	sender.EXPECT().Count("dialattempts", float64(1), "test2:test2", "test:test", "network:tcp", "address_family:ipv4")
+	sender.EXPECT().Timing("connect", gomock.Any(), "test2:test2", "test:test", "network:tcp", "address_family:ipv4", "error:false")
 	sender.EXPECT().Timing("gotcon", gomock.Any(), "test2:test2", "test:test", "reused:false", "idle:false")
 	sender.EXPECT().Timing("tls", gomock.Any(), "test2:test2", "test:test", "error:false")
 	sender.EXPECT().Timing("wroteheaders", gomock.Any(), "test2:test2", "test:test")